@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -12,7 +13,7 @@ type ErrorOffsetOutOfRange struct {
 }
 
 func (e ErrorOffsetOutOfRange) GRPCStatus() *status.Status {
-	st := status.New(404, fmt.Sprintf("offset out of range: %d", e.Offset))
+	st := status.New(codes.OutOfRange, fmt.Sprintf("offset out of range: %d", e.Offset))
 	msg := fmt.Sprintf("The requested offset is outside the log's range: %d", e.Offset)
 	d := &errdetails.LocalizedMessage{
 		Locale:  "en-US",
@@ -28,3 +29,464 @@ func (e ErrorOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrorOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrorNoCommittedOffset struct {
+	Group     string
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrorNoCommittedOffset) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("no committed offset: %s/%s/%d", e.Group, e.Topic, e.Partition))
+	msg := fmt.Sprintf("Group %q has not committed an offset for topic %q, partition %d", e.Group, e.Topic, e.Partition)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorNoCommittedOffset) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorOutOfOrderSequence struct {
+	ProducerID uint64
+	Sequence   uint64
+	Expected   uint64
+}
+
+func (e ErrorOutOfOrderSequence) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf("out of order sequence: %d", e.Sequence))
+	msg := fmt.Sprintf("Producer %d sent sequence %d, expected sequence %d", e.ProducerID, e.Sequence, e.Expected)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorTxnNotOpen struct {
+	TxnID uint64
+}
+
+func (e ErrorTxnNotOpen) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf("transaction not open: %d", e.TxnID))
+	msg := fmt.Sprintf("Transaction %d does not exist or has already been committed or aborted", e.TxnID)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorTxnNotOpen) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorResourceExhausted struct {
+	Reason string
+}
+
+func (e ErrorResourceExhausted) GRPCStatus() *status.Status {
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("resource exhausted: %s", e.Reason))
+	msg := fmt.Sprintf("The record was not appended because %s", e.Reason)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	q := &errdetails.QuotaFailure{
+		Violations: []*errdetails.QuotaFailure_Violation{{Subject: "log", Description: e.Reason}},
+	}
+	std, err := st.WithDetails(d, q)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorResourceExhausted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorRecordExpired struct {
+	Offset uint64
+}
+
+func (e ErrorRecordExpired) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("record expired: %d", e.Offset))
+	msg := fmt.Sprintf("The record at offset %d has expired", e.Offset)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorRecordExpired) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorKeyNotFound struct {
+	Key []byte
+}
+
+func (e ErrorKeyNotFound) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("key not found: %q", e.Key))
+	msg := fmt.Sprintf("The log holds no record with key %q", e.Key)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorKeyNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorRecordTooLarge struct {
+	Size uint64
+	Max  uint64
+}
+
+func (e ErrorRecordTooLarge) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("record too large: %d bytes", e.Size))
+	msg := fmt.Sprintf("The record takes %d bytes, more than the limit of %d bytes", e.Size, e.Max)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	br := &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "record", Description: msg}},
+	}
+	std, err := st.WithDetails(d, br)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorRecordTooLarge) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorControlRecord struct{}
+
+func (e ErrorControlRecord) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, "control records cannot be produced")
+	msg := "Control records are written by the log to mark transactions and cannot be produced by clients"
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	br := &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "record.control", Description: msg}},
+	}
+	std, err := st.WithDetails(d, br)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorControlRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorSchemaViolation struct {
+	Version uint32
+	Reason  string
+}
+
+func (e ErrorSchemaViolation) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("record value does not conform to schema version %d", e.Version))
+	msg := fmt.Sprintf("The record value does not conform to version %d of the log's schema: %s", e.Version, e.Reason)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorSchemaViolation) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorInvalidSchema struct {
+	Reason string
+}
+
+func (e ErrorInvalidSchema) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, "invalid schema")
+	msg := fmt.Sprintf("The schema is invalid: %s", e.Reason)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorInvalidSchema) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorIncompatibleSchema struct {
+	Latest uint32
+	Reason string
+}
+
+func (e ErrorIncompatibleSchema) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf("schema is incompatible with version %d", e.Latest))
+	msg := fmt.Sprintf("The schema is incompatible with version %d of the log's schema: %s", e.Latest, e.Reason)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorIncompatibleSchema) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorSchemaNotFound struct {
+	Version uint32
+}
+
+func (e ErrorSchemaNotFound) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("schema version not found: %d", e.Version))
+	msg := fmt.Sprintf("The log has no schema version %d", e.Version)
+	if e.Version == 0 {
+		msg = "The log has no schema"
+	}
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorSchemaNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorCorrupt struct {
+	Reason string
+}
+
+func (e ErrorCorrupt) GRPCStatus() *status.Status {
+	st := status.New(codes.DataLoss, "log data is corrupt")
+	msg := fmt.Sprintf("The log's data is corrupt: %s", e.Reason)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorCorrupt) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrorNotLeader is returned by a replica which cannot serve a request that only the leader serves. Leader is the
+// address of the leader, if the replica knows it; clients read it back with LeaderHint.
+type ErrorNotLeader struct {
+	Leader string
+}
+
+func (e ErrorNotLeader) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, "not the leader")
+	msg := "The server is not the leader and the leader is unknown"
+	if e.Leader != "" {
+		msg = fmt.Sprintf("The server is not the leader, retry with the leader at %s", e.Leader)
+	}
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	info := &errdetails.ErrorInfo{
+		Reason:   notLeaderReason,
+		Domain:   errorDomain,
+		Metadata: map[string]string{"leader": e.Leader},
+	}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+const (
+	errorDomain     = "dclog"
+	notLeaderReason = "NOT_LEADER"
+)
+
+// LeaderHint returns the address of the leader carried by an ErrorNotLeader received from a server.
+func LeaderHint(err error) (string, bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.Unavailable {
+		return "", false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == errorDomain && info.Reason == notLeaderReason {
+			leader := info.Metadata["leader"]
+			return leader, leader != ""
+		}
+	}
+	return "", false
+}
+
+type ErrorReadOnly struct{}
+
+func (e ErrorReadOnly) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, "log is read-only")
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: "The log is opened read-only and does not accept changes",
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorReadOnly) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorLocked struct{}
+
+func (e ErrorLocked) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, "log directory is locked")
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: "The log directory is locked by another process",
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorLocked) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorNotOpen struct{}
+
+func (e ErrorNotOpen) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, "log is not open")
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: "The log is not open, because it is being set up or failed to reset",
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorNotOpen) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorInternal struct {
+	Reason string
+}
+
+func (e ErrorInternal) GRPCStatus() *status.Status {
+	msg, localized := "internal error", "The server failed to handle the request"
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+		localized += ": " + e.Reason
+	}
+	st := status.New(codes.Internal, msg)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: localized,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorInternal) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrorPermissionDenied struct {
+	Subject string
+	Role    string
+}
+
+func (e ErrorPermissionDenied) GRPCStatus() *status.Status {
+	st := status.New(codes.PermissionDenied, fmt.Sprintf("%s does not have the %s role", e.Subject, e.Role))
+	msg := fmt.Sprintf("The client %q is not granted the %s role which the request requires", e.Subject, e.Role)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrorPermissionDenied) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
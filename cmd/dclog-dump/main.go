@@ -0,0 +1,153 @@
+// Command dclog-dump prints the entries of a log's segments without opening the log, to inspect damaged or live
+// log directories.
+//
+// Usage:
+//
+//	dclog-dump [-value text|hex|json] [-from offset] [-to offset] <log directory | segment.store | segment.index>
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"github.com/kartpop/dclog/internal/log"
+)
+
+func main() {
+	value := flag.String("value", "text", "how to print record values: text, hex or json")
+	from := flag.Uint64("from", 0, "lowest offset to print")
+	to := flag.Uint64("to", math.MaxUint64, "highest offset to print")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <log directory | segment.store | segment.index>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	format, ok := valueFormats[*value]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown value format %q\n", *value)
+		os.Exit(2)
+	}
+	if err := dump(flag.Arg(0), format, *from, *to); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// valueFormats print record values.
+var valueFormats = map[string]func([]byte) string{
+	"text": func(b []byte) string {
+		return strconv.Quote(string(b))
+	},
+	"hex": hex.EncodeToString,
+	"json": func(b []byte) string {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, b); err != nil {
+			return fmt.Sprintf("%q (not JSON: %v)", b, err)
+		}
+		return buf.String()
+	},
+}
+
+// dump prints the segments of a log directory, or a single segment given its store or index file.
+func dump(target string, format func([]byte) string, from, to uint64) error {
+	fi, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		base := strings.TrimSuffix(target, path.Ext(target))
+		return dumpSegment(base+".store", base+".index", format, from, to)
+	}
+	files, err := ioutil.ReadDir(target)
+	if err != nil {
+		return err
+	}
+	var bases []uint64
+	for _, file := range files {
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".store"), 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	for _, base := range bases {
+		name := path.Join(target, strconv.FormatUint(base, 10))
+		if err = dumpSegment(name+".store", name+".index", format, from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpSegment prints the entries of a segment whose offsets are within [from, to].
+func dumpSegment(storePath, indexPath string, format func([]byte) string, from, to uint64) error {
+	fmt.Printf("segment %s, %s\n", storePath, indexPath)
+	summary, err := log.ScanSegment(storePath, indexPath, func(e log.SegmentEntry) error {
+		if e.Offset < from || e.Offset > to {
+			return nil
+		}
+		fmt.Printf("offset=%d position=%d length=%d", e.Offset, e.Position, e.Length)
+		if e.Err != nil {
+			fmt.Printf(" error=%q\n", e.Err)
+			return nil
+		}
+		fmt.Printf(" checksum=%s%s value=%s\n", e.Checksum, fields(e.Record), format(e.Record.Value))
+		if e.Record.Offset != e.Offset {
+			fmt.Printf("  record holds offset %d\n", e.Record.Offset)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d entries, %d store bytes", summary.Entries, summary.StoreBytes)
+	if summary.UnindexedBytes > 0 {
+		fmt.Printf(", %d bytes at the end of the store are not indexed", summary.UnindexedBytes)
+	}
+	fmt.Print("\n\n")
+	return nil
+}
+
+// fields prints the record's metadata which is set.
+func fields(r *api.Record) string {
+	var b strings.Builder
+	if r.Timestamp != 0 {
+		fmt.Fprintf(&b, " timestamp=%s", time.Unix(0, r.Timestamp).UTC().Format(time.RFC3339Nano))
+	}
+	if r.Key != nil {
+		fmt.Fprintf(&b, " key=%q", r.Key)
+	}
+	if r.ProducerId != 0 {
+		fmt.Fprintf(&b, " producer_id=%d sequence=%d", r.ProducerId, r.Sequence)
+	}
+	if r.TxnId != 0 {
+		fmt.Fprintf(&b, " txn_id=%d", r.TxnId)
+	}
+	if r.Control != api.Control_CONTROL_NONE {
+		fmt.Fprintf(&b, " control=%s", r.Control)
+	}
+	if r.ExpiresAt != 0 {
+		fmt.Fprintf(&b, " expires_at=%s", time.Unix(0, r.ExpiresAt).UTC().Format(time.RFC3339Nano))
+	}
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/kartpop/dclog/internal/log"
+)
+
+// export writes records of a log as JSON Lines. The records held back by an open transaction are not written, and
+// the command then fails naming their offsets, once the records before them are written.
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	from := flags.Uint64("from", 0, "lowest offset to export")
+	to := flags.Uint64("to", math.MaxUint64, "highest offset to export")
+	since := flags.String("since", "", "export records with a timestamp at or after this RFC 3339 time")
+	until := flags.String("until", "", "export records with a timestamp at or before this RFC 3339 time")
+	encoding := flags.String("value", log.EncodingBase64, "encoding of keys and values: base64 or utf8")
+	output := flags.String("o", "", "file to write to instead of the standard output")
+	c := segmentFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s export [flags] <log directory>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	opts := log.ExportOptions{From: *from, To: to, Encoding: *encoding}
+	var err error
+	if opts.Since, err = parseTime(*since); err != nil {
+		return err
+	}
+	if opts.Until, err = parseTime(*until); err != nil {
+		return err
+	}
+	// the log is opened read-only, so that a live log can be exported
+	c.ReadOnly = true
+	l, err := log.NewLog(flags.Arg(0), *c)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := log.Export(l, w, opts)
+	if errors.Is(err, log.ErrOpenTxn) {
+		return fmt.Errorf("exported %d records up to the last stable offset: %w; export again once the transaction ends", n, err)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d records\n", n)
+	return nil
+}
+
+// import_ creates a log from the records of JSON Lines written by export. The log directory must not hold a log.
+func import_(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	preserve := flags.Bool("preserve-offsets", false, "append records at their exported offsets instead of the log's next offsets")
+	input := flags.String("i", "", "file to read from instead of the standard input")
+	c := segmentFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s import [flags] <log directory>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if err := os.MkdirAll(flags.Arg(0), 0755); err != nil {
+		return err
+	}
+	if files, err := os.ReadDir(flags.Arg(0)); err != nil {
+		return err
+	} else if len(files) > 0 {
+		return fmt.Errorf("%s is not empty; import creates a new log", flags.Arg(0))
+	}
+	l, err := log.NewLog(flags.Arg(0), *c)
+	if err != nil {
+		return err
+	}
+	n, err := log.Import(l, r, log.ImportOptions{PreserveOffsets: *preserve})
+	if err != nil {
+		l.Close()
+		return fmt.Errorf("imported %d records: %w", n, err)
+	}
+	if err = l.Sync(); err != nil {
+		l.Close()
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d records\n", n)
+	return l.Close()
+}
+
+// parseTime parses an RFC 3339 time, returning the zero time for an empty string.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
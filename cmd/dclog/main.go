@@ -0,0 +1,56 @@
+// Command dclog runs maintenance tasks on log directories, such as repairs and exports.
+//
+// Usage:
+//
+//	dclog <command> [flags] <log directory>
+//
+// The commands are:
+//
+//	repair    find and fix damaged segments
+//	export    write records as JSON Lines
+//	import    create a log from JSON Lines
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// command is a dclog subcommand. run receives the arguments following the command's name.
+type command struct {
+	name, summary string
+	run           func(args []string) error
+}
+
+var commands = []command{
+	{"repair", "find and fix damaged segments", repair},
+	{"export", "write records as JSON Lines", export},
+	{"import", "create a log from JSON Lines", import_},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
+
+// usage prints the available commands.
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags] <log directory>\n\ncommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s%s\n", cmd.name, cmd.summary)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kartpop/dclog/internal/log"
+)
+
+// repair prints the changes which make a log directory consistent and applies them once confirmed.
+func repair(args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	yes := flags.Bool("yes", false, "apply the changes without asking for confirmation")
+	dryRun := flags.Bool("n", false, "print the changes without applying them")
+	c := segmentFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s repair [flags] <log directory>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	dir := flags.Arg(0)
+	plan, err := log.PlanRepair(dir, *c)
+	if err != nil {
+		return err
+	}
+	if len(plan) == 0 {
+		fmt.Println("nothing to repair")
+		return nil
+	}
+	for _, action := range plan {
+		fmt.Println(action)
+	}
+	if *dryRun {
+		return nil
+	}
+	if !*yes && !confirm(fmt.Sprintf("apply %d changes to %s?", len(plan), dir)) {
+		return errors.New("repair cancelled")
+	}
+	if err = log.Repair(dir, *c, plan); err != nil {
+		return err
+	}
+	fmt.Printf("applied %d changes\n", len(plan))
+	return nil
+}
+
+// segmentFlags defines the flags of the segment configuration, which must match the log's.
+func segmentFlags(flags *flag.FlagSet) *log.Config {
+	c := &log.Config{}
+	flags.Uint64Var(&c.Segment.MaxStoreBytes, "max-store-bytes", 1024, "maximum store size of the log's segments")
+	flags.Uint64Var(&c.Segment.MaxIndexBytes, "max-index-bytes", 1024, "maximum index size of the log's segments")
+	flags.Uint64Var(&c.Limits.MaxRecordBytes, "max-record-bytes", 0, "maximum record size of the log, zero for no limit")
+	return c
+}
+
+// confirm asks a yes or no question on the terminal and returns whether it was answered yes.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
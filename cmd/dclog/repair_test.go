@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"github.com/kartpop/dclog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepairKeepsQuarantineGap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repair-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	// segment 0 holds offsets 0 and 1, segment 2 offset 2 and the active segment 3 is empty
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		if i > 0 {
+			_, err = l.Roll()
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, l.Close())
+	storePath := path.Join(dir, "2.store")
+	b, err := ioutil.ReadFile(storePath)
+	require.NoError(t, err)
+	b[10] ^= 0xff // a byte of the record's value
+	require.NoError(t, ioutil.WriteFile(storePath, b, 0644))
+	c.Scrub.Quarantine = true
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	corruptions, err := l.Scrub()
+	require.NoError(t, err)
+	require.Len(t, corruptions, 1)
+	require.True(t, corruptions[0].Quarantined)
+	require.NoError(t, l.Close())
+
+	// the empty segment following the quarantined one is not a lost roll
+	require.NoError(t, repair([]string{"-yes", dir}))
+	c.Scrub.Quarantine = false
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
@@ -29,6 +29,7 @@ require (
 
 require (
 	github.com/golang/protobuf v1.5.2
+	github.com/santhosh-tekuri/jsonschema/v5 v5.0.0
 	github.com/stretchr/testify v1.8.0
 	github.com/tysonmote/gommap v0.0.2
 	google.golang.org/genproto v0.0.0-20220913154956-18f8339a66a5
@@ -0,0 +1,51 @@
+// Package auth grants roles to the clients of the server, identified by the subject of their TLS certificate.
+package auth
+
+import (
+	"sync"
+
+	api "github.com/kartpop/dclog/api/v1"
+)
+
+// RoleAdmin is the role required to call the Admin service.
+const RoleAdmin = "admin"
+
+// Authorizer holds the roles granted to subjects.
+type Authorizer struct {
+	mu    sync.RWMutex
+	roles map[string]map[string]bool
+}
+
+// New returns an Authorizer granting no role.
+func New() *Authorizer {
+	return &Authorizer{roles: make(map[string]map[string]bool)}
+}
+
+// Grant grants roles to a subject.
+func (a *Authorizer) Grant(subject string, roles ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.roles[subject] == nil {
+		a.roles[subject] = make(map[string]bool)
+	}
+	for _, role := range roles {
+		a.roles[subject][role] = true
+	}
+}
+
+// Revoke revokes a role from a subject.
+func (a *Authorizer) Revoke(subject, role string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.roles[subject], role)
+}
+
+// Authorize returns api.ErrorPermissionDenied unless the subject was granted the role.
+func (a *Authorizer) Authorize(subject, role string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !a.roles[subject][role] {
+		return api.ErrorPermissionDenied{Subject: subject, Role: role}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthorizer(t *testing.T) {
+	a := New()
+	require.Equal(t, codes.PermissionDenied, status.Code(a.Authorize("root", RoleAdmin)))
+
+	a.Grant("root", RoleAdmin)
+	require.NoError(t, a.Authorize("root", RoleAdmin))
+	require.Error(t, a.Authorize("nobody", RoleAdmin))
+
+	a.Revoke("root", RoleAdmin)
+	require.Error(t, a.Authorize("root", RoleAdmin))
+}
@@ -0,0 +1,94 @@
+package log
+
+import (
+	"errors"
+
+	api "github.com/kartpop/dclog/api/v1"
+)
+
+var (
+	errEmptyBatch     = errors.New("batch holds no record")
+	errMixedProducers = errors.New("batch holds records of several producers")
+)
+
+// AppendBatch appends records to the log atomically: if any record cannot be appended, the records of the batch
+// which were appended are truncated and none is left in the log. It returns the offsets of the first and the last
+// record. Hooks are only notified of the batch once all of its records are appended.
+//
+// The records are checked as by Append before anything is written. They must all carry the same producer ID and,
+// if it is set, consecutive sequences. A batch whose sequences the producer already appended is a retry, and the
+// offsets of the original records are returned without appending anything.
+//
+// Atomicity does not extend to crashes: a crash part way through a batch may leave a prefix of the batch in the
+// log once it is recovered. When the producer retries such a batch, only the records missing from the log are
+// appended, so the offsets of the batch's records are then not consecutive.
+func (l *Log) AppendBatch(records []*api.Record) (first, last uint64, err error) {
+	if len(records) == 0 {
+		return 0, 0, errEmptyBatch
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.ReadOnly {
+		return 0, 0, ErrReadOnly
+	}
+	if err = l.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	producer := records[0].ProducerId
+	for i, record := range records {
+		if err = l.checkTxn(record); err != nil {
+			return 0, 0, err
+		}
+		if record.ProducerId != producer {
+			return 0, 0, errMixedProducers
+		}
+		if i > 0 && producer != 0 && record.Sequence != records[i-1].Sequence+1 {
+			return 0, 0, api.ErrorOutOfOrderSequence{
+				ProducerID: producer,
+				Sequence:   record.Sequence,
+				Expected:   records[i-1].Sequence + 1,
+			}
+		}
+	}
+	first, duplicate, err := l.checkProducer(records[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if duplicate {
+		p := l.producers[producer]
+		if lastSeq := records[len(records)-1].Sequence; lastSeq <= p.last() {
+			last, _, err = p.lookup(lastSeq)
+			return first, last, err
+		}
+		// a crash left a prefix of the batch in the log
+		records = records[p.last()-records[0].Sequence+1:]
+	}
+	var need uint64
+	for _, record := range records {
+		need += recordBytes(record)
+	}
+	if l.Config.Limits.MaxLogBytes != 0 || l.Config.Limits.MinFreeBytes != 0 {
+		if err = l.checkBytes(need); err != nil {
+			return 0, 0, err
+		}
+	}
+	next := l.activeSegment.nextOffset
+	if !duplicate {
+		first = next
+	}
+	var events []event
+	hold := func(e event) { events = append(events, e) }
+	for _, record := range records {
+		if last, err = l.appendWith(record, hold); err != nil {
+			// the hooks were not told about the batch, so they are not told about its removal either
+			if rerr := l.cut(next, (*segment).Remove); rerr != nil {
+				return 0, 0, rerr
+			}
+			return 0, 0, err
+		}
+	}
+	for _, e := range events {
+		l.emit(e)
+	}
+	return first, last, nil
+}
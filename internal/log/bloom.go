@@ -0,0 +1,56 @@
+package log
+
+import (
+	"hash/fnv"
+)
+
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// bloomFilter tells whether a key may have been added to it, with a false positive rate of about 1% for
+// bloomBitsPerKey bits per key, and no false negatives.
+type bloomFilter struct {
+	bits []uint64
+}
+
+// newBloomFilter creates a filter sized for the given number of keys.
+func newBloomFilter(keys int) *bloomFilter {
+	words := (keys*bloomBitsPerKey + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	return &bloomFilter{bits: make([]uint64, words)}
+}
+
+// Add adds the key to the filter.
+func (b *bloomFilter) Add(key []byte) {
+	h1, h2 := bloomHash(key)
+	n := uint32(len(b.bits) * 64)
+	for i := uint32(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % n
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MayContain returns false if the key was definitely not added to the filter.
+func (b *bloomFilter) MayContain(key []byte) bool {
+	h1, h2 := bloomHash(key)
+	n := uint32(len(b.bits) * 64)
+	for i := uint32(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % n
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHash derives the two hashes combined by the filter's hash functions from a 64-bit FNV-1a hash.
+func bloomHash(key []byte) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
@@ -0,0 +1,27 @@
+package log
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter(t *testing.T) {
+	b := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		b.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	for i := 0; i < 1000; i++ {
+		require.True(t, b.MayContain([]byte(fmt.Sprintf("key-%d", i))))
+	}
+
+	// false positives should stay near the expected rate
+	var positives int
+	for i := 0; i < 10000; i++ {
+		if b.MayContain([]byte(fmt.Sprintf("other-%d", i))) {
+			positives++
+		}
+	}
+	require.Less(t, positives, 300)
+}
@@ -1,9 +1,91 @@
 package log
 
+import (
+	"time"
+
+	api "github.com/kartpop/dclog/api/v1"
+)
+
 type Config struct {
+	// ReadOnly opens the log's files without ever writing, truncating or creating them, so that a log owned by
+	// another process, or stored on a read-only mount, can be inspected safely.
+	ReadOnly bool
+	// FS is the filesystem the segments are stored on. It defaults to the operating system's.
+	FS FS
+
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
 	}
+	Limits struct {
+		// MinFreeBytes is the free space which must remain on the log's filesystem after an append.
+		MinFreeBytes uint64
+		// MaxLogBytes caps the bytes taken by the log's stores and indexes.
+		MaxLogBytes uint64
+		// MaxRecordBytes caps the size of a marshaled record. Appends of larger records are rejected and stored
+		// lengths above the limit are treated as corruption when read.
+		MaxRecordBytes uint64
+	}
+	Expiry struct {
+		// CleanupInterval is how often sealed segments whose records have all expired are removed.
+		// Zero disables the background cleanup.
+		CleanupInterval time.Duration
+	}
+	Merge struct {
+		// Interval is how often adjacent sealed segments are merged while the merged segment fits within the
+		// Segment limits. Zero disables the background merger.
+		Interval time.Duration
+	}
+	Scrub struct {
+		// Interval is how often the scrubber verifies the next sealed segment. Zero disables the scrubber.
+		Interval time.Duration
+		// Quarantine moves corrupt segments out of the log, into the quarantine subdirectory.
+		Quarantine bool
+		// OnCorrupt, if set, is called with every corruption the scrubber finds.
+		OnCorrupt func(*CorruptionError)
+	}
+	Producers struct {
+		// Expiration is how long the state of an idempotent producer is kept after the timestamp of its latest
+		// record, so that the state of producers which stopped appending does not grow without bound. A retry
+		// from an expired producer is appended again. It defaults to a day.
+		Expiration time.Duration
+	}
+	Txn struct {
+		// Timeout is how long a transaction may stay open before the log aborts it, so that a transaction
+		// abandoned by its producer does not hold back read-committed consumers. Zero disables the timeout.
+		Timeout time.Duration
+	}
+	Cache struct {
+		// TailRecords is the number of records most recently appended to the active segment which are served from
+		// memory, without flushing the store's write buffer. Zero disables the tail cache.
+		TailRecords uint64
+	}
+	Hooks struct {
+		// BufferSize is the number of events queued for the callbacks registered on the log.
+		BufferSize int
+	}
+	Memory struct {
+		// MaxRecords bounds the number of records kept by a MemoryLog. The oldest records are evicted first.
+		MaxRecords uint64
+		// OnEvict, if set, is called with every record a MemoryLog evicts or truncates, while the log is locked.
+		OnEvict func(*api.Record)
+	}
+}
+
+// withDefaults returns the configuration with defaults for the settings which are not set.
+func (c Config) withDefaults() Config {
+	if c.Segment.MaxStoreBytes == 0 {
+		c.Segment.MaxStoreBytes = 1024
+	}
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1024
+	}
+	if c.Producers.Expiration == 0 {
+		c.Producers.Expiration = defaultProducerExpiration
+	}
+	if c.Hooks.BufferSize == 0 {
+		c.Hooks.BufferSize = defaultHooksBuffer
+	}
+	return c
 }
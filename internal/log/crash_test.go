@@ -0,0 +1,123 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrashRecovery(t *testing.T) {
+	for seed := int64(0); seed < 50; seed++ {
+		dir, err := ioutil.TempDir("", "crash-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		rng := rand.New(rand.NewSource(seed))
+		fs := NewFaultFS(seed)
+		c := Config{FS: fs}
+		c.Segment.MaxStoreBytes = 256
+		c.Segment.MaxIndexBytes = 120
+
+		var values [][]byte               // value appended at every offset
+		acknowledged := map[uint64]bool{} // offsets which must survive a crash
+		for round := 0; round < 10; round++ {
+			log, err := NewLog(dir, c)
+			require.NoError(t, err, "seed %d round %d", seed, round)
+
+			// recovery keeps every acknowledged record and invents none
+			next := log.activeSegment.nextOffset
+			for off := range acknowledged {
+				require.Less(t, off, next, "seed %d round %d: acknowledged record %d was lost", seed, round, off)
+			}
+			for off := uint64(0); off < next; off++ {
+				record, err := log.Read(off)
+				if acknowledged[off] {
+					require.NoError(t, err, "seed %d round %d: acknowledged record %d was lost", seed, round, off)
+				}
+				if err != nil {
+					if off < uint64(len(values)) {
+						values[off] = nil // the record was lost, leaving a gap
+					}
+					continue
+				}
+				require.Less(t, off, uint64(len(values)), "seed %d round %d: record %d was invented", seed, round, off)
+				require.NotNil(t, values[off], "seed %d round %d: record %d was invented", seed, round, off)
+				require.Equal(t, values[off], record.Value, "seed %d round %d: record %d was altered", seed, round, off)
+				acknowledged[off] = true // the record is durable from now on
+			}
+			for off := uint64(len(values)); off < next; off++ {
+				values = append(values, nil)
+			}
+			values = values[:next]
+
+			for i := rng.Intn(30); i > 0; i-- {
+				value := make([]byte, 1+rng.Intn(40))
+				rng.Read(value)
+				off, err := log.Append(&api.Record{Value: value})
+				require.NoError(t, err)
+				require.Equal(t, uint64(len(values)), off)
+				values = append(values, value)
+				if rng.Intn(8) == 0 {
+					failSyncs := rng.Intn(4) == 0
+					fs.FailSyncs(failSyncs)
+					err = log.Sync()
+					fs.FailSyncs(false)
+					if !failSyncs {
+						require.NoError(t, err)
+						for off, value := range values {
+							if value != nil {
+								acknowledged[uint64(off)] = true
+							}
+						}
+					}
+				}
+			}
+
+			// the process dies without closing the log
+			log.stop()
+			require.NoError(t, unlockDir(log.lock))
+			require.NoError(t, fs.Crash(rng.Intn(2) == 0))
+		}
+	}
+}
+
+// TestFaultFSCrash checks the failures injected by FaultFS.
+func TestFaultFSCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faultfs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := dir + "/file"
+	fs := NewFaultFS(1)
+
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("synced"))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	_, err = f.Write([]byte(" lost"))
+	require.NoError(t, err)
+	fs.FailSyncs(true)
+	require.Equal(t, ErrSyncFailed, f.Sync())
+	fs.FailSyncs(false)
+
+	require.NoError(t, fs.Crash(false))
+	b, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, []byte("synced"), b)
+	_, err = f.Write([]byte("after"))
+	require.Equal(t, ErrCrashed, err)
+
+	f, err = fs.OpenFile(name, os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte(" torn"))
+	require.NoError(t, err)
+	require.NoError(t, fs.Crash(true))
+	b, err = ioutil.ReadFile(name)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix([]byte("synced torn"), b))
+	require.GreaterOrEqual(t, len(b), len("synced"))
+}
@@ -0,0 +1,133 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// ChecksumStatus tells whether a record read by ScanSegment matches its checksum.
+type ChecksumStatus int
+
+const (
+	ChecksumNone     ChecksumStatus = iota // the record was written without a checksum
+	ChecksumOK                             // the record matches its checksum
+	ChecksumMismatch                       // the record does not match its checksum
+)
+
+func (s ChecksumStatus) String() string {
+	switch s {
+	case ChecksumOK:
+		return "ok"
+	case ChecksumMismatch:
+		return "mismatch"
+	}
+	return "none"
+}
+
+// SegmentEntry describes an index entry of a segment and the record it points at.
+type SegmentEntry struct {
+	Offset   uint64 // the segment's base offset plus the entry's relative offset
+	Position uint64 // position of the record in the store
+	Length   uint64 // length of the marshaled record, as stored before it
+	Record   *api.Record
+	Checksum ChecksumStatus
+	Err      error // why the record could not be read, in which case Record is nil
+}
+
+// SegmentSummary describes the files of a segment scanned by ScanSegment.
+type SegmentSummary struct {
+	BaseOffset     uint64
+	Entries        uint64
+	StoreBytes     uint64
+	UnindexedBytes uint64 // bytes at the end of the store which no entry points at
+}
+
+// ScanSegment reads the files of a segment directly, without opening a log, and calls fn for every entry of its
+// index, in order. Damaged entries are reported through SegmentEntry.Err rather than stopping the scan, so that
+// it can be used to inspect logs which fail to open. The segment's base offset is read from the store's name.
+func ScanSegment(storePath, indexPath string, fn func(SegmentEntry) error) (SegmentSummary, error) {
+	var summary SegmentSummary
+	base, err := strconv.ParseUint(strings.TrimSuffix(path.Base(storePath), path.Ext(storePath)), 10, 64)
+	if err != nil {
+		return summary, fmt.Errorf("reading the base offset from %s: %w", storePath, err)
+	}
+	summary.BaseOffset = base
+	storeFile, err := os.Open(storePath)
+	if err != nil {
+		return summary, err
+	}
+	defer storeFile.Close()
+	fi, err := storeFile.Stat()
+	if err != nil {
+		return summary, err
+	}
+	summary.StoreBytes = uint64(fi.Size())
+	b, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return summary, err
+	}
+	idx := &index{mmap: b, size: uint64(len(b)), readOnly: true}
+	idx.trim()
+	if summary.StoreBytes < lenWidth {
+		// trim keeps a first entry of zeros, which only points at a record if the store holds one
+		idx.size = 0
+	}
+
+	var end uint64 // end of the furthest record read
+	for i := uint64(0); i < idx.size/entWidth; i++ {
+		rel, pos, _ := idx.Read(int64(i))
+		entry := SegmentEntry{Offset: base + uint64(rel), Position: pos}
+		entry.Record, entry.Length, entry.Err = readRecordAt(storeFile, pos, summary.StoreBytes)
+		if entry.Err == nil {
+			if pos+lenWidth+entry.Length > end {
+				end = pos + lenWidth + entry.Length
+			}
+			entry.Checksum = ChecksumOK
+			if entry.Record.Checksum == 0 {
+				entry.Checksum = ChecksumNone
+			} else if ok, _ := verifyChecksum(entry.Record); !ok {
+				entry.Checksum = ChecksumMismatch
+			}
+		}
+		summary.Entries++
+		if err = fn(entry); err != nil {
+			return summary, err
+		}
+	}
+	if summary.StoreBytes > end {
+		summary.UnindexedBytes = summary.StoreBytes - end
+	}
+	return summary, nil
+}
+
+// readRecordAt reads the length-prefixed record stored at the given position of a store file of the given size.
+func readRecordAt(f *os.File, pos, size uint64) (*api.Record, uint64, error) {
+	if pos+lenWidth > size {
+		return nil, 0, errors.New("record length is beyond the end of the store")
+	}
+	b := make([]byte, lenWidth)
+	if _, err := f.ReadAt(b, int64(pos)); err != nil {
+		return nil, 0, err
+	}
+	n := enc.Uint64(b)
+	if n > size-pos-lenWidth {
+		return nil, n, fmt.Errorf("record length %d is beyond the end of the store", n)
+	}
+	b = make([]byte, n)
+	if _, err := f.ReadAt(b, int64(pos+lenWidth)); err != nil {
+		return nil, n, err
+	}
+	record := &api.Record{}
+	if err := proto.Unmarshal(b, record); err != nil {
+		return nil, n, fmt.Errorf("unmarshaling record: %w", err)
+	}
+	return record, n, nil
+}
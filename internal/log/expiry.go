@@ -0,0 +1,51 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/kartpop/dclog/api/v1"
+)
+
+// expired returns whether the record's expiry has passed.
+func expired(record *api.Record, now time.Time) bool {
+	return record.ExpiresAt != 0 && record.ExpiresAt <= now.UnixNano()
+}
+
+// observeExpiry updates the latest expiry of the segment's records with a record stored in the segment.
+// Transaction markers never expire, but they do not keep a segment whose records expired from being removed.
+func (s *segment) observeExpiry(record *api.Record) {
+	if record.Control != api.Control_CONTROL_NONE {
+		return
+	}
+	if record.ExpiresAt == 0 {
+		s.persistent = true
+	} else if record.ExpiresAt > s.expiresAt {
+		s.expiresAt = record.ExpiresAt
+	}
+}
+
+// Expired returns whether every record in the segment, other than transaction markers, has expired.
+func (s *segment) Expired(now time.Time) bool {
+	return !s.persistent && s.nextOffset > s.baseOffset && s.expiresAt <= now.UnixNano()
+}
+
+// RemoveExpired removes the oldest sealed segments whose records have all expired.
+// Like Truncate, it only removes segments from the front of the log so that the remaining offsets stay contiguous.
+// Segments holding records of open transactions are kept, so that their begin markers are not lost.
+// It is called periodically when Config.Expiry.CleanupInterval is set.
+func (l *Log) RemoveExpired() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	now, lso := time.Now(), l.lastStableOffset()
+	n := 0
+	for n < len(l.segments)-1 && l.segments[n].Expired(now) && l.segments[n].nextOffset <= lso {
+		n++
+	}
+	return l.removeFront(n)
+}
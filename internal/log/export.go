@@ -0,0 +1,293 @@
+package log
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+	"unicode/utf8"
+
+	api "github.com/kartpop/dclog/api/v1"
+)
+
+var (
+	// ErrOpenTxn is returned by Export when records in the exported range were held back by an open transaction.
+	ErrOpenTxn = errors.New("records are held back by an open transaction")
+	// ErrNotEmpty is returned by Import when the log already holds records.
+	ErrNotEmpty = errors.New("log is not empty")
+)
+
+// Encodings of the keys, header values and values of exported records.
+const (
+	EncodingBase64 = "base64"
+	EncodingUTF8   = "utf8"
+)
+
+// ExportedRecord is a line of the JSON Lines written by Export and read by Import.
+type ExportedRecord struct {
+	Offset    uint64            `json:"offset"`
+	Key       string            `json:"key,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+	ExpiresAt int64             `json:"expires_at,omitempty"`
+	Value     string            `json:"value"`
+	// Encoding is the encoding of the key, the header values and the value, EncodingBase64 unless set.
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// ExportOptions selects the records written by Export and how their keys and values are encoded.
+type ExportOptions struct {
+	// From and To bound the offsets exported, inclusively. A nil To exports up to the end of the log.
+	From uint64
+	To   *uint64
+	// Since and Until bound the timestamps of the records exported, inclusively. Zero times are unbounded.
+	Since, Until time.Time
+	// Encoding is the encoding of keys, header values and values, EncodingBase64 unless set. With EncodingUTF8, the
+	// records whose key, header values or value are not valid UTF-8 are still written in base64.
+	Encoding string
+}
+
+// ImportOptions configures how Import fills a new log.
+type ImportOptions struct {
+	// PreserveOffsets appends every record at its exported offset, leaving gaps between offsets which were not
+	// exported. The offsets must be increasing and at least the log's next offset. Otherwise records are
+	// appended at the log's next offsets, from its initial offset.
+	//
+	// Offsets in a gap are out of range: consumers must skip them, as the server's consumers do through
+	// Log.SkipGap, rather than wait for them to be appended.
+	PreserveOffsets bool
+}
+
+// Export writes the log's records selected by the options as JSON Lines, and returns the number of records written.
+// Records are read as consumers with read-committed isolation see them, so that transaction markers, records of
+// aborted transactions and expired records are left out.
+//
+// The records appended to the log after the export started are not exported. Records at or beyond the log's last
+// stable offset, which is the first offset of the oldest open transaction, are held back as well: once the
+// records below it are written, Export fails with an error matching ErrOpenTxn and naming the offsets which were
+// not exported.
+func Export(l *Log, w io.Writer, opts ExportOptions) (n uint64, err error) {
+	if opts.Encoding == "" {
+		opts.Encoding = EncodingBase64
+	}
+	if opts.Encoding != EncodingBase64 && opts.Encoding != EncodingUTF8 {
+		return 0, fmt.Errorf("unknown encoding %q", opts.Encoding)
+	}
+	since, until := int64(0), int64(0)
+	if !opts.Since.IsZero() {
+		since = opts.Since.UnixNano()
+	}
+	if !opts.Until.IsZero() {
+		until = opts.Until.UnixNano()
+	}
+	to := uint64(math.MaxUint64)
+	if opts.To != nil {
+		to = *opts.To
+	}
+	l.mu.RLock()
+	if err = l.checkOpen(); err != nil {
+		l.mu.RUnlock()
+		return 0, err
+	}
+	end := l.activeSegment.nextOffset
+	l.mu.RUnlock()
+	if end == 0 {
+		return 0, nil
+	}
+	if end-1 < to {
+		to = end - 1
+	}
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	for _, seg := range l.Stats().Segments {
+		if seg.NextOffset <= opts.From || seg.BaseOffset > to {
+			continue
+		}
+		// records are not appended in timestamp order, but a segment all of whose records are out of the time
+		// range can be skipped
+		if seg.NewestTimestamp != 0 && (since != 0 && seg.NewestTimestamp < since || until != 0 && seg.OldestTimestamp > until) {
+			continue
+		}
+		off := seg.BaseOffset
+		if off < opts.From {
+			off = opts.From
+		}
+		for off < seg.NextOffset && off <= to {
+			record, err := l.ReadCommitted(off)
+			if errors.As(err, &api.ErrorOffsetOutOfRange{}) {
+				break
+			}
+			if err != nil {
+				return n, err
+			}
+			if record.Offset > to || record.Offset >= seg.NextOffset {
+				break
+			}
+			off = record.Offset + 1
+			if since != 0 && record.Timestamp < since || until != 0 && record.Timestamp > until {
+				continue
+			}
+			if err = enc.Encode(exportRecord(record, opts.Encoding)); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	if err = buf.Flush(); err != nil {
+		return n, err
+	}
+	// the transactions which were open at the end of the export held back the records from the last stable
+	// offset on all along, since it only moves up as they end
+	l.mu.RLock()
+	lso := l.lastStableOffset()
+	l.mu.RUnlock()
+	if lso < opts.From {
+		lso = opts.From
+	}
+	if lso <= to {
+		return n, fmt.Errorf("%w: offsets %d to %d were not exported", ErrOpenTxn, lso, to)
+	}
+	return n, nil
+}
+
+// exportRecord converts a record to its exported form.
+func exportRecord(record *api.Record, encoding string) ExportedRecord {
+	if encoding == EncodingUTF8 && !(utf8.Valid(record.Key) && utf8.Valid(record.Value)) {
+		encoding = EncodingBase64
+	}
+	for _, v := range record.Headers {
+		if encoding == EncodingUTF8 && !utf8.Valid(v) {
+			encoding = EncodingBase64
+		}
+	}
+	e := ExportedRecord{
+		Offset:    record.Offset,
+		Timestamp: record.Timestamp,
+		ExpiresAt: record.ExpiresAt,
+		Encoding:  encoding,
+	}
+	encode := func(b []byte) string {
+		if encoding == EncodingUTF8 {
+			return string(b)
+		}
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	e.Key, e.Value = encode(record.Key), encode(record.Value)
+	if len(record.Headers) > 0 {
+		e.Headers = make(map[string]string, len(record.Headers))
+		for k, v := range record.Headers {
+			e.Headers[k] = encode(v)
+		}
+	}
+	return e
+}
+
+// Import fills a new log with the records of JSON Lines written by Export, and returns the number of records
+// appended. Timestamps, expiries and headers are kept. It fails with ErrNotEmpty, without appending anything,
+// unless the log is empty.
+func Import(l *Log, r io.Reader, opts ImportOptions) (n uint64, err error) {
+	l.mu.RLock()
+	empty := len(l.segments) == 1 && l.activeSegment.nextOffset == l.activeSegment.baseOffset
+	l.mu.RUnlock()
+	if !empty {
+		return 0, ErrNotEmpty
+	}
+	dec := json.NewDecoder(r)
+	for {
+		var e ExportedRecord
+		if err = dec.Decode(&e); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("record %d: %w", n+1, err)
+		}
+		record, err := importRecord(e)
+		if err != nil {
+			return n, fmt.Errorf("record at offset %d: %w", e.Offset, err)
+		}
+		if opts.PreserveOffsets {
+			_, err = l.appendAt(record, e.Offset)
+		} else {
+			_, err = l.Append(record)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// importRecord converts an exported record back to a record.
+func importRecord(e ExportedRecord) (*api.Record, error) {
+	var decode func(s string) ([]byte, error)
+	switch e.Encoding {
+	case EncodingUTF8:
+		decode = func(s string) ([]byte, error) { return []byte(s), nil }
+	case EncodingBase64, "":
+		decode = base64.StdEncoding.DecodeString
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", e.Encoding)
+	}
+	record := &api.Record{Timestamp: e.Timestamp, ExpiresAt: e.ExpiresAt}
+	var err error
+	if record.Key, err = decode(e.Key); err != nil {
+		return nil, err
+	}
+	if len(record.Key) == 0 {
+		record.Key = nil
+	}
+	if record.Value, err = decode(e.Value); err != nil {
+		return nil, err
+	}
+	for k, v := range e.Headers {
+		if record.Headers == nil {
+			record.Headers = make(map[string][]byte, len(e.Headers))
+		}
+		if record.Headers[k], err = decode(v); err != nil {
+			return nil, fmt.Errorf("header %q: %w", k, err)
+		}
+	}
+	return record, nil
+}
+
+// appendAt appends a record at the given offset, which must not be lower than the log's next offset. A new
+// segment is started at the offset if it is beyond the next offset; an empty active segment is replaced by it.
+func (l *Log) appendAt(record *api.Record, offset uint64) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
+	active := l.activeSegment
+	if offset < active.nextOffset {
+		return 0, fmt.Errorf("offset %d is lower than the log's next offset %d", offset, active.nextOffset)
+	}
+	if offset > active.nextOffset {
+		// the new segment deliberately does not follow the active one
+		if err := markGap(l.Config.fs(), l.Dir, offset); err != nil {
+			return 0, err
+		}
+	}
+	if offset > active.nextOffset && active.nextOffset == active.baseOffset {
+		// the empty segment is only removed once the new one is active, so that a failure leaves a usable log
+		if err := l.newSegment(offset); err != nil {
+			return 0, err
+		}
+		n := len(l.segments)
+		l.segments = append(l.segments[:n-2], l.segments[n-1])
+		if err := l.removeSegment(active); err != nil {
+			return 0, err
+		}
+	} else if offset > active.nextOffset {
+		if err := l.roll(offset); err != nil {
+			return 0, err
+		}
+	}
+	return l.append(record)
+}
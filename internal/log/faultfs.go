@@ -0,0 +1,296 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+)
+
+var (
+	// ErrCrashed is returned by the files of a FaultFS which were opened before it crashed.
+	ErrCrashed = errors.New("file was lost in a crash")
+	// ErrSyncFailed is returned by the syncs a FaultFS is set to fail.
+	ErrSyncFailed = errors.New("sync failed")
+)
+
+// FaultFS is a filesystem which injects the failures of a crashing machine, for testing that the log recovers
+// from them. It stores files on the operating system's filesystem, but remembers what was last synced to them:
+// Crash rolls the files back to their synced content, or tears their unsynced writes at a random byte.
+//
+// Creating, renaming and removing files through the FS is durable. Files renamed or removed directly on the
+// operating system's filesystem must not be crashed.
+type FaultFS struct {
+	mu        sync.Mutex
+	rand      *rand.Rand
+	synced    map[string][]byte // durable content of the files opened since the last crash
+	files     []*faultFile      // files opened since the last crash
+	mappings  []*faultMapping   // mappings made since the last crash
+	failSyncs bool
+}
+
+// NewFaultFS creates a FaultFS whose random choices are drawn from the given seed.
+func NewFaultFS(seed int64) *FaultFS {
+	return &FaultFS{
+		rand:   rand.New(rand.NewSource(seed)),
+		synced: make(map[string][]byte),
+	}
+}
+
+// FailSyncs makes every sync of a file or a mapping fail with ErrSyncFailed, without persisting anything, until
+// it is called with false.
+func (fs *FaultFS) FailSyncs(fail bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.failSyncs = fail
+}
+
+// Crash simulates a crash of the machine: the files opened since the last crash lose the writes which were not
+// synced. With torn set, the unsynced writes of every file instead reach it up to a random byte, as if the crash
+// happened while they were being written back. Files and mappings opened before the crash fail with ErrCrashed.
+func (fs *FaultFS) Crash(torn bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	// changes made through mappings are in the page cache, where the crash may find them
+	for _, m := range fs.mappings {
+		if m.writable && !m.file.closed {
+			if _, err := m.file.File.WriteAt(m.b, 0); err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range fs.files {
+		f.crashed = true
+		if !f.closed {
+			f.File.Close()
+		}
+	}
+	for name, synced := range fs.synced {
+		current, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		content := synced
+		if torn {
+			// the writes reach the file in order, up to the cut
+			same := 0
+			for same < len(current) && same < len(synced) && current[same] == synced[same] {
+				same++
+			}
+			cut := same + fs.rand.Intn(len(current)-same+1)
+			content = append([]byte(nil), current[:cut]...)
+			if cut < len(synced) {
+				content = append(content, synced[cut:]...)
+			}
+		}
+		if err = ioutil.WriteFile(name, content, 0644); err != nil {
+			return err
+		}
+	}
+	fs.files, fs.mappings = nil, nil
+	fs.synced = make(map[string][]byte)
+	return nil
+}
+
+// OpenFile opens the named file. The content of a file opened for the first time since the last crash is durable.
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.synced[name]; !ok {
+		content, err := ioutil.ReadFile(name)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		fs.synced[name] = content
+	}
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	ff := &faultFile{File: f, fs: fs}
+	fs.files = append(fs.files, ff)
+	return ff, nil
+}
+
+// Stat returns the named file's info.
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Truncate changes the named file's size. The change is lost in a crash until the file is synced.
+func (fs *FaultFS) Truncate(name string, size int64) error {
+	return os.Truncate(name, size)
+}
+
+// Remove removes the named file, durably.
+func (fs *FaultFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	delete(fs.synced, name)
+	return nil
+}
+
+// Rename renames the named file, durably. The file keeps the content which was durable under its old name.
+func (fs *FaultFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := os.Rename(oldname, newname); err != nil {
+		return err
+	}
+	if synced, ok := fs.synced[oldname]; ok {
+		fs.synced[newname] = synced
+		delete(fs.synced, oldname)
+	}
+	return nil
+}
+
+// MkdirAll creates the named directory and its missing parents, durably.
+func (fs *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// Map maps a copy of the file in memory. Changes made through a writable mapping are written to the file when
+// the mapping is synced or unmapped.
+func (fs *FaultFS) Map(f File, writable bool) (Mapping, error) {
+	ff := f.(*faultFile)
+	fi, err := ff.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, fi.Size())
+	if _, err = ff.ReadAt(b, 0); err != nil {
+		return nil, err
+	}
+	m := &faultMapping{file: ff, b: b, writable: writable}
+	fs.mu.Lock()
+	fs.mappings = append(fs.mappings, m)
+	fs.mu.Unlock()
+	return m, nil
+}
+
+// sync records the current content of the file as durable.
+func (fs *FaultFS) sync(f *faultFile) error {
+	if fs.failSyncs {
+		return ErrSyncFailed
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	fs.synced[f.Name()] = content
+	return nil
+}
+
+// faultFile is a file opened from a FaultFS.
+type faultFile struct {
+	*os.File
+	fs      *FaultFS
+	crashed bool
+	closed  bool
+}
+
+// check returns ErrCrashed if the FS crashed since the file was opened.
+func (f *faultFile) check() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.crashed {
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+// Sync records the file's current content as durable, unless syncs are set to fail.
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.crashed {
+		return ErrCrashed
+	}
+	return f.fs.sync(f)
+}
+
+func (f *faultFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.crashed {
+		return ErrCrashed
+	}
+	f.closed = true
+	return f.File.Close()
+}
+
+// faultMapping is a file mapped in memory by a FaultFS.
+type faultMapping struct {
+	file     *faultFile
+	b        []byte
+	writable bool
+}
+
+func (m *faultMapping) Bytes() []byte {
+	return m.b
+}
+
+// Sync writes the mapping to the file and records it as durable.
+func (m *faultMapping) Sync() error {
+	m.file.fs.mu.Lock()
+	defer m.file.fs.mu.Unlock()
+	if m.file.crashed {
+		return ErrCrashed
+	}
+	if m.file.fs.failSyncs {
+		return ErrSyncFailed
+	}
+	if m.writable {
+		if _, err := m.file.File.WriteAt(m.b, 0); err != nil {
+			return err
+		}
+	}
+	return m.file.fs.sync(m.file)
+}
+
+// Unmap writes the mapping to the file, without persisting it.
+func (m *faultMapping) Unmap() error {
+	if !m.writable {
+		return nil
+	}
+	_, err := m.file.WriteAt(m.b, 0)
+	return err
+}
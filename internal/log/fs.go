@@ -0,0 +1,109 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tysonmote/gommap"
+)
+
+// FS is the filesystem the segments' stores and indexes are kept on. The default implementation is the
+// operating system's; FaultFS injects the failures of a crashing machine for testing.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Truncate(name string, size int64) error
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// Map maps the whole file in memory. Changes made through a writable mapping reach the file once the
+	// mapping is synced.
+	Map(f File, writable bool) (Mapping, error)
+}
+
+// File is a file opened from an FS.
+type File interface {
+	io.Writer
+	io.WriterAt
+	io.ReaderAt
+	io.Closer
+	Name() string
+	Sync() error
+	Truncate(size int64) error
+}
+
+// Mapping is a file mapped in memory by an FS.
+type Mapping interface {
+	Bytes() []byte
+	// Sync writes the changes made to the mapping to the file and waits for them to be persisted.
+	Sync() error
+	Unmap() error
+}
+
+// fs returns the filesystem configured for the log, which defaults to the operating system's.
+func (c Config) fs() FS {
+	if c.FS == nil {
+		return osFS{}
+	}
+	return c.FS
+}
+
+// osFS is the operating system's filesystem.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Truncate(name string, size int64) error {
+	return os.Truncate(name, size)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// Map maps the file with mmap. The file must have been opened from the operating system's filesystem.
+func (osFS) Map(f File, writable bool) (Mapping, error) {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return nil, fmt.Errorf("cannot map %s: not an operating system file", f.Name())
+	}
+	prot := gommap.PROT_READ
+	if writable {
+		prot |= gommap.PROT_WRITE
+	}
+	m, err := gommap.Map(fd.Fd(), prot, gommap.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return osMapping(m), nil
+}
+
+// osMapping is a file mapped with mmap.
+type osMapping gommap.MMap
+
+func (m osMapping) Bytes() []byte {
+	return m
+}
+
+func (m osMapping) Sync() error {
+	return gommap.MMap(m).Sync(gommap.MS_SYNC)
+}
+
+func (m osMapping) Unmap() error {
+	return gommap.MMap(m).UnsafeUnmap()
+}
@@ -0,0 +1,32 @@
+package log
+
+import (
+	"os"
+)
+
+// gapExt is the extension of the marker file of a segment which does not follow the preceding segment on purpose.
+const gapExt = ".gap"
+
+// markGap records that the segment at the given base offset follows a gap in the log's offsets, such as left by a
+// quarantined segment, so that the segment is not taken for a lost roll while it is empty. The marker is created
+// before the gap is, and removed with the segment.
+func markGap(fs FS, dir string, base uint64) error {
+	f, err := fs.OpenFile(segmentPath(dir, base, gapExt), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// hasGap returns whether the segment at the given base offset was marked as following a gap.
+func hasGap(fs FS, dir string, base uint64) (bool, error) {
+	_, err := fs.Stat(segmentPath(dir, base, gapExt))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
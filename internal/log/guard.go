@@ -0,0 +1,65 @@
+package log
+
+import (
+	"fmt"
+	"syscall"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxAssignedBytes is the most bytes the offset, checksum and timestamp assigned by a segment can add to a
+// marshaled record.
+const maxAssignedBytes = 11 + 5 + 11
+
+// checkSpace verifies that the record can be appended without exceeding the log's byte quota or going below the
+// free space floor of its filesystem. It is called before anything is written, so that a full disk never leaves
+// torn records behind.
+func (l *Log) checkSpace(record *api.Record) error {
+	if l.Config.Limits.MaxLogBytes == 0 && l.Config.Limits.MinFreeBytes == 0 {
+		return nil
+	}
+	return l.checkBytes(recordBytes(record))
+}
+
+// recordBytes returns the most bytes the record can take in a segment's store and index once appended.
+func recordBytes(record *api.Record) uint64 {
+	return uint64(lenWidth+proto.Size(record)+maxAssignedBytes) + entWidth
+}
+
+// checkBytes verifies that the given number of bytes can be appended to the log.
+func (l *Log) checkBytes(need uint64) error {
+	if max := l.Config.Limits.MaxLogBytes; max != 0 {
+		if size := l.size(); size+need > max {
+			return api.ErrorResourceExhausted{Reason: fmt.Sprintf("the log would exceed its quota of %d bytes", max)}
+		}
+	}
+	if min := l.Config.Limits.MinFreeBytes; min != 0 {
+		free, err := freeBytes(l.Dir)
+		if err != nil {
+			return err
+		}
+		if free < need+min {
+			return api.ErrorResourceExhausted{Reason: fmt.Sprintf("the disk would have less than %d free bytes", min)}
+		}
+	}
+	return nil
+}
+
+// size returns the bytes taken by the records and index entries of all segments.
+func (l *Log) size() uint64 {
+	var size uint64
+	for _, seg := range l.segments {
+		size += seg.store.size + seg.index.size
+	}
+	return size
+}
+
+// freeBytes returns the bytes available to unprivileged users on the filesystem holding dir.
+func freeBytes(dir string) (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, err
+	}
+	return fs.Bavail * uint64(fs.Bsize), nil
+}
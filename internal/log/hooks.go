@@ -0,0 +1,169 @@
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// defaultHooksBuffer is the number of events queued for the hooks when Config.Hooks.BufferSize is not set.
+const defaultHooksBuffer = 1024
+
+// RecoverInfo describes the state of the log after it was recovered from its files.
+type RecoverInfo struct {
+	Segments     int
+	LowestOffset uint64
+	NextOffset   uint64
+}
+
+type eventKind int
+
+const (
+	eventAppend eventKind = iota
+	eventSegmentRolled
+	eventSegmentDeleted
+	eventRecover
+)
+
+type event struct {
+	kind       eventKind
+	offset     uint64 // offset of the appended record
+	base, next uint64 // offsets of the rolled or deleted segment
+	recover    RecoverInfo
+	recoverFns []func(RecoverInfo) // callbacks registered when the recovery happened
+}
+
+// hooks holds the callbacks registered on the log and the queue of events they are delivered from.
+type hooks struct {
+	mu               sync.RWMutex
+	onAppend         []func(offset uint64)
+	onSegmentRolled  []func(base, next uint64)
+	onSegmentDeleted []func(base, next uint64)
+	onRecover        []func(RecoverInfo)
+	lastRecover      *RecoverInfo
+
+	events  chan event
+	dropped uint64
+}
+
+// OnAppend registers a callback called with the offset of every appended record.
+//
+// Callbacks are called asynchronously, in order, from a single goroutine. Events are queued in a buffer of
+// Config.Hooks.BufferSize events; when the callbacks fall behind and the buffer is full, new events are dropped
+// and counted by HooksDropped.
+func (l *Log) OnAppend(fn func(offset uint64)) {
+	l.hooks.mu.Lock()
+	defer l.hooks.mu.Unlock()
+	l.hooks.onAppend = append(l.hooks.onAppend, fn)
+}
+
+// OnSegmentRolled registers a callback called with the base and next offsets of every segment which is sealed
+// because it reached its maximum size.
+func (l *Log) OnSegmentRolled(fn func(base, next uint64)) {
+	l.hooks.mu.Lock()
+	defer l.hooks.mu.Unlock()
+	l.hooks.onSegmentRolled = append(l.hooks.onSegmentRolled, fn)
+}
+
+// OnSegmentDeleted registers a callback called with the base and next offsets of every segment removed by a
+// truncation, the expiry cleanup or the scrubber's quarantine. Segments merged into the preceding segment are not
+// reported, since their records remain in the log.
+func (l *Log) OnSegmentDeleted(fn func(base, next uint64)) {
+	l.hooks.mu.Lock()
+	defer l.hooks.mu.Unlock()
+	l.hooks.onSegmentDeleted = append(l.hooks.onSegmentDeleted, fn)
+}
+
+// OnRecover registers a callback called whenever the log rebuilds its state from its files: when it is opened
+// or reset, and after TruncateAfter. The callback is also called with the latest recovery when it is registered.
+func (l *Log) OnRecover(fn func(RecoverInfo)) {
+	l.hooks.mu.Lock()
+	defer l.hooks.mu.Unlock()
+	l.hooks.onRecover = append(l.hooks.onRecover, fn)
+	if l.hooks.lastRecover != nil {
+		l.emit(event{kind: eventRecover, recover: *l.hooks.lastRecover, recoverFns: []func(RecoverInfo){fn}})
+	}
+}
+
+// HooksDropped returns the number of events dropped because the hooks' buffer was full.
+func (l *Log) HooksDropped() uint64 {
+	return atomic.LoadUint64(&l.hooks.dropped)
+}
+
+// emit queues an event for the hooks without blocking.
+func (l *Log) emit(e event) {
+	select {
+	case l.hooks.events <- e:
+	default:
+		atomic.AddUint64(&l.hooks.dropped, 1)
+	}
+}
+
+// emitRecover records and queues a recovery of the log.
+func (l *Log) emitRecover() {
+	info := RecoverInfo{
+		Segments:     len(l.segments),
+		LowestOffset: l.segments[0].baseOffset,
+		NextOffset:   l.segments[len(l.segments)-1].nextOffset,
+	}
+	l.hooks.mu.Lock()
+	defer l.hooks.mu.Unlock()
+	l.hooks.lastRecover = &info
+	l.emit(event{kind: eventRecover, recover: info, recoverFns: l.hooks.onRecover})
+}
+
+// removeSegment removes a segment's files and notifies the hooks.
+func (l *Log) removeSegment(seg *segment) error {
+	if err := seg.Remove(); err != nil {
+		return err
+	}
+	l.emit(event{kind: eventSegmentDeleted, base: seg.baseOffset, next: seg.nextOffset})
+	return nil
+}
+
+// runHooks delivers the queued events to the registered callbacks until the log is closed.
+// Events queued before the log was closed are still delivered.
+func (l *Log) runHooks() {
+	defer l.wg.Done()
+	for {
+		select {
+		case e := <-l.hooks.events:
+			l.deliver(e)
+		case <-l.done:
+			for {
+				select {
+				case e := <-l.hooks.events:
+					l.deliver(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver calls the callbacks registered for an event.
+func (l *Log) deliver(e event) {
+	l.hooks.mu.RLock()
+	onAppend, onSegmentRolled := l.hooks.onAppend, l.hooks.onSegmentRolled
+	onSegmentDeleted := l.hooks.onSegmentDeleted
+	l.hooks.mu.RUnlock()
+	switch e.kind {
+	case eventAppend:
+		for _, fn := range onAppend {
+			fn(e.offset)
+		}
+	case eventSegmentRolled:
+		for _, fn := range onSegmentRolled {
+			fn(e.base, e.next)
+		}
+	case eventSegmentDeleted:
+		for _, fn := range onSegmentDeleted {
+			fn(e.base, e.next)
+		}
+	case eventRecover:
+		// callbacks registered later were called with the latest recovery on registration
+		for _, fn := range e.recoverFns {
+			fn(e.recover)
+		}
+	}
+}
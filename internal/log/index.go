@@ -2,9 +2,6 @@ package log
 
 import (
 	"io"
-	"os"
-
-	"github.com/tysonmote/gommap"
 )
 
 var (
@@ -16,31 +13,56 @@ var (
 // index stores the Offset and Position of the records present in the store struct.
 // It comprises a persisted file and a memory-mapped file.
 type index struct {
-	file *os.File
-	mmap gommap.MMap
-	size uint64
+	file     File
+	mapping  Mapping
+	mmap     []byte
+	size     uint64
+	readOnly bool
 }
 
 // newIndex creates and returns the index when service is restarted.
 // The index file is first grown to its maximum size before memory mapping; once mapped, size cannot be changed.
-func newIndex(f *os.File, c Config) (*index, error) {
+// A read-only index is mapped as is, without growing the file.
+func newIndex(f File, c Config) (*index, error) {
 	idx := &index{
-		file: f,
+		file:     f,
+		readOnly: c.ReadOnly,
 	}
-	fi, err := os.Stat(f.Name())
+	fs := c.fs()
+	fi, err := fs.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
 	idx.size = uint64(fi.Size())
-	if err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
-		return nil, err
-	}
-	if idx.mmap, err = gommap.Map(idx.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED); err != nil {
-		return nil, err
+	if idx.readOnly {
+		if idx.size == 0 { // an empty file cannot be mapped
+			return idx, nil
+		}
+		if idx.mapping, err = fs.Map(f, false); err != nil {
+			return nil, err
+		}
+	} else {
+		if err = fs.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
+			return nil, err
+		}
+		if idx.mapping, err = fs.Map(f, true); err != nil {
+			return nil, err
+		}
 	}
+	idx.mmap = idx.mapping.Bytes()
+	idx.trim()
 	return idx, nil
 }
 
+// trim drops the zeroed entries at the end of an index file which was not closed gracefully, such as the index
+// of a live log or of a process which crashed. Only the first entry can legitimately have a zero position.
+func (i *index) trim() {
+	i.size -= i.size % entWidth
+	for i.size > entWidth && enc.Uint64(i.mmap[i.size-posWidth:i.size]) == 0 {
+		i.size -= entWidth
+	}
+}
+
 // Read takes in an offset for a record and returns its position in the store file.
 // The offset is relative to the segment's base offset.
 func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
@@ -63,6 +85,9 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 
 // Write appends the given offset and position to the index.
 func (i *index) Write(off uint32, pos uint64) error {
+	if i.readOnly {
+		return ErrReadOnly
+	}
 	if uint64(len(i.mmap)) < i.size+entWidth {
 		return io.EOF
 	}
@@ -72,6 +97,26 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// Truncate discards all entries from the given relative offset onwards.
+func (i *index) Truncate(in uint32) {
+	size := uint64(in) * entWidth
+	if size >= i.size {
+		return
+	}
+	for b := size; b < i.size; b++ {
+		i.mmap[b] = 0
+	}
+	i.size = size
+}
+
+// Sync waits for the index's entries to be persisted.
+func (i *index) Sync() error {
+	if i.readOnly {
+		return nil
+	}
+	return i.mapping.Sync()
+}
+
 // Name returns the index's file path.
 func (i *index) Name() string {
 	return i.file.Name()
@@ -79,8 +124,17 @@ func (i *index) Name() string {
 
 // Close gracefully closes the index file.
 // The file is truncated to remove the empty space appended to the file during service restart (before memory mapping).
+// A read-only index is only unmapped and closed.
 func (i *index) Close() error {
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+	if i.readOnly {
+		if i.mapping != nil {
+			if err := i.mapping.Unmap(); err != nil {
+				return err
+			}
+		}
+		return i.file.Close()
+	}
+	if err := i.mapping.Sync(); err != nil {
 		return err
 	}
 	if err := i.file.Sync(); err != nil {
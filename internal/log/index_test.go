@@ -41,7 +41,15 @@ func TestIndex(t *testing.T) {
 	// index Read should return error when reading past existing entries
 	_, _, err = idx.Read(int64(len(entries)))
 	require.Equal(t, io.EOF, err)
-	_ = idx.Close()
 
-	// TODO: index should build its state from existing file
+	// index should build its state from an existing file which was not closed, and thus still has its maximum size
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, entries[1].Off, off)
+	require.Equal(t, entries[1].Pos, pos)
+	_ = idx.Close()
 }
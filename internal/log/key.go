@@ -0,0 +1,96 @@
+package log
+
+import (
+	"bytes"
+	"time"
+
+	api "github.com/kartpop/dclog/api/v1"
+)
+
+// observeKey adds a record stored in the segment to the segment's key index.
+// The active segment maps every key to the offset of its latest record; once sealed, only a bloom filter of the
+// segment's keys is kept in memory.
+func (s *segment) observeKey(record *api.Record) {
+	if len(record.Key) == 0 || s.keys == nil {
+		return
+	}
+	s.keys[string(record.Key)] = record.Offset
+}
+
+// sealKeys replaces the segment's key index with a bloom filter of its keys.
+func (s *segment) sealKeys() {
+	if s.keys == nil {
+		return
+	}
+	if len(s.keys) > 0 {
+		s.bloom = newBloomFilter(len(s.keys))
+		for key := range s.keys {
+			s.bloom.Add([]byte(key))
+		}
+	}
+	s.keys = nil
+}
+
+// lookupKey returns the offset of the segment's latest record with the given key which visible accepts.
+func (s *segment) lookupKey(key []byte, visible func(*api.Record) bool) (offset uint64, ok bool, err error) {
+	if s.keys != nil {
+		if offset, ok = s.keys[string(key)]; !ok {
+			return 0, false, nil
+		}
+		record, err := s.Read(offset)
+		if err != nil {
+			return 0, false, err
+		}
+		if visible(record) {
+			return offset, true, nil
+		}
+		// an earlier record with the key may be visible
+		ok = false
+	} else if s.bloom == nil || !s.bloom.MayContain(key) {
+		return 0, false, nil
+	}
+	err = s.scan(func(record *api.Record) error {
+		if bytes.Equal(record.Key, key) && visible(record) {
+			offset, ok = record.Offset, true
+		}
+		return nil
+	})
+	return offset, ok, err
+}
+
+// LookupKey returns the latest record appended with the given key, as consumers with read-committed isolation see
+// the log: records of aborted or open transactions and transaction markers are skipped.
+// It returns api.ErrorKeyNotFound if no record has the key and api.ErrorRecordExpired if the latest one expired.
+func (l *Log) LookupKey(key []byte) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+	lso := l.lastStableOffset()
+	visible := func(record *api.Record) bool {
+		if record.Offset >= lso || record.Control != api.Control_CONTROL_NONE {
+			return false
+		}
+		t, ok := l.txns[record.TxnId]
+		return !ok || t.status != txnAborted
+	}
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		offset, ok, err := l.segments[i].lookupKey(key, visible)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		record, err := l.segments[i].Read(offset)
+		if err != nil {
+			return nil, err
+		}
+		if expired(record, time.Now()) {
+			return nil, api.ErrorRecordExpired{Offset: offset}
+		}
+		return record, nil
+	}
+	return nil, api.ErrorKeyNotFound{Key: key}
+}
@@ -0,0 +1,40 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// lockFileName is the name of the file in the log directory holding the advisory lock of the process owning the log.
+const lockFileName = "LOCK"
+
+// ErrLocked is returned by NewLog when another Log, possibly in another process, has opened the directory for writing.
+var ErrLocked = errors.New("log directory is locked by another process")
+
+// lockDir takes an exclusive advisory lock on the log directory. The lock is released by unlockDir,
+// or by the operating system when the process exits.
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(path.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// unlockDir releases the lock taken by lockDir.
+func unlockDir(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -1,41 +1,124 @@
 package log
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/kartpop/dclog/api/v1"
 )
 
+// ErrReadOnly is returned by the methods which would modify a log opened with Config.ReadOnly.
+var ErrReadOnly = errors.New("log is opened read-only")
+
 // Log encapsulates the slice of all segments and a pointer to the active segment.
 type Log struct {
-	mu sync.RWMutex
+	mu      sync.RWMutex
+	merging sync.Mutex // held by a merge, whose files are written without holding mu
 
 	Dir           string
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	producers     map[uint64]*producerState
+	txns          map[uint64]*txn
+	nextTxnID     uint64
+	lock          *os.File
+	scrubMetrics  ScrubMetrics
+	scrubCursor   uint64 // base offset from which the background scrubber looks for the next segment to verify
+	hooks         hooks
+	syncedBase    uint64 // base offset of the first segment which may hold records appended since the last Sync
+	open          int32  // set once the segments are recovered, until the log is closed or reset
+
+	done chan struct{} // closed to stop the background tasks
+	wg   sync.WaitGroup
 }
 
 // NewLog creates and sets up the Log datastructure.
+// Unless the log is opened read-only, it locks the directory for the lifetime of the log and fails with ErrLocked
+// if another Log holds the lock.
 func NewLog(dir string, c Config) (*Log, error) {
-	if c.Segment.MaxStoreBytes == 0 {
-		c.Segment.MaxStoreBytes = 1024
-	}
-	if c.Segment.MaxIndexBytes == 0 {
-		c.Segment.MaxIndexBytes = 1024
-	}
+	c = c.withDefaults()
 	l := &Log{
 		Dir:    dir,
 		Config: c,
 	}
-	return l, l.setup()
+	l.hooks.events = make(chan event, c.Hooks.BufferSize)
+	if !c.ReadOnly {
+		var err error
+		if l.lock, err = lockDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.setup(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	l.start()
+	l.setOpen(true)
+	return l, nil
+}
+
+// start runs the log's background tasks until the log is closed.
+func (l *Log) start() {
+	l.done = make(chan struct{})
+	l.wg.Add(1)
+	go l.runHooks()
+	if l.Config.ReadOnly {
+		return
+	}
+	if l.Config.Expiry.CleanupInterval > 0 {
+		l.wg.Add(1)
+		go l.runPeriodically(l.Config.Expiry.CleanupInterval, l.RemoveExpired)
+	}
+	if l.Config.Merge.Interval > 0 {
+		l.wg.Add(1)
+		go l.runPeriodically(l.Config.Merge.Interval, l.MergeSegments)
+	}
+	if l.Config.Scrub.Interval > 0 {
+		l.wg.Add(1)
+		go l.runPeriodically(l.Config.Scrub.Interval, l.scrubNext)
+	}
+	if timeout := l.Config.Txn.Timeout; timeout > 0 {
+		// transactions are aborted at most half a timeout late
+		l.wg.Add(1)
+		go l.runPeriodically(timeout-timeout/2, l.abortTimedOutTxns)
+	}
+}
+
+// runPeriodically runs the task at the given interval until the log is closed.
+// Errors are ignored; the task is retried at the next tick.
+func (l *Log) runPeriodically(interval time.Duration, task func() error) {
+	defer l.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			_ = task()
+		}
+	}
+}
+
+// stop stops the log's background tasks and waits for them to return.
+func (l *Log) stop() {
+	if l.done == nil {
+		return
+	}
+	close(l.done)
+	l.wg.Wait()
+	l.done = nil
 }
 
 // setup reads the log's segment files from persistent storage and sets up the log for use.
@@ -47,8 +130,14 @@ func (l *Log) setup() error {
 	}
 	var baseOffsets []uint64
 	for _, file := range files {
+		if path.Ext(file.Name()) != ".store" { // each segment has a store and an index file
+			continue
+		}
 		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool { // so that []segments is sorted old to new
@@ -58,16 +147,129 @@ func (l *Log) setup() error {
 		if err = l.newSegment(baseOffsets[i]); err != nil {
 			return err
 		}
-		i++ // baseOffsets has double entries corresponding to store and index files for each segment
+		if err = l.removeOverlapping(); err != nil {
+			return err
+		}
+	}
+	if err = l.removeLostRolls(); err != nil {
+		return err
+	}
+	if !l.Config.ReadOnly {
+		if err = l.removeMergeFiles(); err != nil {
+			return err
+		}
+	}
+	if l.segments == nil && l.Config.ReadOnly {
+		return fmt.Errorf("read-only log has no segments: %s", l.Dir)
 	}
 	if l.segments == nil {
 		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
 			return err
 		}
 	}
+	if err = l.loadState(); err != nil {
+		return err
+	}
+	l.emitRecover()
+	return nil
+}
+
+// loadState rebuilds the log's in-memory state, such as the last sequences of idempotent producers and
+// the status of transactions and the segments' key indexes, by replaying the records stored in the segments.
+// The state of the producers starts from the producer snapshot, which covers the records removed from the log.
+func (l *Log) loadState() error {
+	producers, snapshotted, err := l.readProducerSnapshot()
+	if err != nil {
+		return err
+	}
+	if snapshotted > l.segments[len(l.segments)-1].nextOffset {
+		// the log was truncated below the records of the snapshot
+		producers, snapshotted = make(map[uint64]*producerState), 0
+	}
+	l.producers = producers
+	l.txns = make(map[uint64]*txn)
+	l.nextTxnID = 1
+	track := func(record *api.Record) {
+		if record.Offset >= snapshotted {
+			l.trackProducer(record)
+		}
+		l.trackTxn(record)
+	}
+	for _, seg := range l.segments {
+		if err := seg.load(track); err != nil {
+			return err
+		}
+		if seg != l.activeSegment {
+			seg.sealKeys()
+		}
+	}
+	l.expireProducers(l.producers, time.Now())
+	return nil
+}
+
+// removeOverlapping removes the last loaded segment if its offsets are covered by the preceding segment,
+// which happens when a merge was interrupted before the merged segments were removed. A segment which only
+// partially overlaps the preceding one holds records found nowhere else, so it is quarantined instead.
+func (l *Log) removeOverlapping() error {
+	n := len(l.segments)
+	if n < 2 || l.Config.ReadOnly {
+		return nil
+	}
+	last := l.segments[n-1]
+	overlaps, covered := overlapping(l.segments[n-2].nextOffset, last.baseOffset, last.nextOffset)
+	if !overlaps {
+		return nil
+	}
+	if covered {
+		if err := l.removeSegment(last); err != nil {
+			return err
+		}
+	} else {
+		if err := last.Close(); err != nil {
+			return err
+		}
+		for _, name := range []string{last.store.Name(), last.index.Name()} {
+			if err := quarantineFile(l.Config.fs(), l.Dir, name); err != nil {
+				return err
+			}
+		}
+	}
+	l.segments = l.segments[:n-1]
+	l.activeSegment = l.segments[n-2]
+	return nil
+}
+
+// removeLostRolls removes the empty segments at the end of the log which do not follow the previous segment, as
+// left by a crash which lost the last records of a segment after the next one was created. Segments marked as
+// following a gap are kept, so that the offsets of the gap are not handed out again.
+func (l *Log) removeLostRolls() error {
+	for n := len(l.segments); n > 1 && !l.Config.ReadOnly; n-- {
+		last := l.segments[n-1]
+		if !lostRoll(l.segments[n-2].nextOffset, last.baseOffset, last.nextOffset) {
+			return nil
+		}
+		gap, err := hasGap(l.Config.fs(), l.Dir, last.baseOffset)
+		if err != nil {
+			return err
+		}
+		if gap {
+			return nil
+		}
+		if err := l.removeSegment(last); err != nil {
+			return err
+		}
+		l.segments = l.segments[:n-1]
+		l.activeSegment = l.segments[n-2]
+	}
 	return nil
 }
 
+// track updates the log's in-memory state with a record which was appended to the log.
+func (l *Log) track(record *api.Record) {
+	l.trackProducer(record)
+	l.trackTxn(record)
+}
+
 // newSegment loads an existing segment or creates a new one given the base offset.
 func (l *Log) newSegment(baseOffset uint64) error {
 	seg, err := newSegment(l.Dir, baseOffset, l.Config)
@@ -85,24 +287,146 @@ func (l *Log) newSegment(baseOffset uint64) error {
 // therefore it is possible for a segment to cross its MaxStoreBytes or MaxIndexBytes limit.
 // Example - if MaxStoreBytes=16 and one appends "hello world" as record value to a segment,
 // its store size would be 8+11=19 before a new segment is created
+//
+// If the record carries a producer ID and a sequence which the producer already appended, the record is not
+// appended again and the offset of the original record is returned.
+// If the record carries a transaction ID, the transaction must be open.
+// Appends fail with api.ErrorResourceExhausted, without writing anything, when the log is out of space.
 func (l *Log) Append(record *api.Record) (offset uint64, err error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err = l.checkTxn(record); err != nil {
+		return 0, err
+	}
+	offset, duplicate, err := l.checkProducer(record)
+	if err != nil || duplicate {
+		return offset, err
+	}
+	return l.append(record)
+}
+
+// append appends a record to the active segment, creating a new segment if the active one is maxed.
+func (l *Log) append(record *api.Record) (offset uint64, err error) {
+	return l.appendWith(record, l.emit)
+}
+
+// appendWith appends a record like append, passing the events of the append to emit.
+func (l *Log) appendWith(record *api.Record, emit func(event)) (offset uint64, err error) {
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if err = l.checkOpen(); err != nil {
+		return 0, err
+	}
+	if err = l.checkSpace(record); err != nil {
+		return 0, err
+	}
 	offset, err = l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
+	l.track(record)
+	emit(event{kind: eventAppend, offset: offset})
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(offset + 1)
+		err = l.rollWith(offset+1, emit)
 	}
 	return offset, err
 }
 
+// roll seals the active segment and makes a new segment starting at the given offset the active one.
+func (l *Log) roll(next uint64) error {
+	return l.rollWith(next, l.emit)
+}
+
+// rollWith rolls the active segment like roll, passing the event of the roll to emit.
+func (l *Log) rollWith(next uint64, emit func(event)) error {
+	seg := l.activeSegment
+	seg.sealKeys()
+	seg.tail = nil
+	emit(event{kind: eventSegmentRolled, base: seg.baseOffset, next: seg.nextOffset})
+	return l.newSegment(next)
+}
+
+// Roll seals the active segment and starts a new one at the next offset, unless the active segment is empty.
+// It returns the base offset of the active segment.
+func (l *Log) Roll() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
+	if seg := l.activeSegment; seg.nextOffset != seg.baseOffset {
+		if err := l.roll(seg.nextOffset); err != nil {
+			return 0, err
+		}
+	}
+	return l.activeSegment.baseOffset, nil
+}
+
+// Sync waits for the records appended so far to be persisted, so that they survive a crash of the machine.
+// Segments sealed since the last Sync are persisted before the active segment.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.ReadOnly {
+		return nil
+	}
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	for _, seg := range l.segments {
+		if seg.baseOffset < l.syncedBase && seg != l.activeSegment {
+			continue
+		}
+		if err := seg.Sync(); err != nil {
+			return err
+		}
+	}
+	l.syncedBase = l.activeSegment.baseOffset
+	return nil
+}
+
 // Read reads a record from the log given its offset.
+// It returns api.ErrorRecordExpired for a record whose expiry has passed.
 func (l *Log) Read(offset uint64) (*api.Record, error) {
 	// TODO: make lock per segment instead of entire log (for all read related methods)
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	record, err := l.read(offset)
+	if err != nil {
+		return nil, err
+	}
+	if expired(record, time.Now()) {
+		return nil, api.ErrorRecordExpired{Offset: offset}
+	}
+	return record, nil
+}
+
+// SkipGap returns the offset of the first record at or after the given offset, skipping the gap between two
+// segments which a quarantined segment, or an import preserving offsets, leaves in the log's offsets. Offsets
+// outside of a gap are returned unchanged.
+func (l *Log) SkipGap(offset uint64) uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.skipGap(offset)
+}
+
+func (l *Log) skipGap(offset uint64) uint64 {
+	for i, seg := range l.segments {
+		if offset < seg.nextOffset {
+			if i > 0 && offset < seg.baseOffset {
+				return seg.baseOffset
+			}
+			return offset
+		}
+	}
+	return offset
+}
+
+func (l *Log) read(offset uint64) (*api.Record, error) {
 	var readSeg *segment
 	// TODO: use binary search instead of linear search to find read segment - can use sort search()
 	for _, seg := range l.segments {
@@ -117,36 +441,124 @@ func (l *Log) Read(offset uint64) (*api.Record, error) {
 	return readSeg.Read(offset)
 }
 
-// Close closes the log safely by closing all segments.
+// Close closes the log safely by stopping its background tasks, closing all segments and releasing the lock on
+// its directory. The lock is released even if a segment fails to close; the first error is returned.
 func (l *Log) Close() error {
+	l.setOpen(false)
+	l.stop()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.closeSegments()
+	if uerr := l.unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// closeSegments closes all segments, even if one fails to close, and returns the first error.
+func (l *Log) closeSegments() error {
+	var err error
 	for _, segment := range l.segments {
-		if err := segment.Close(); err != nil {
-			return err
+		if cerr := segment.Close(); err == nil {
+			err = cerr
 		}
 	}
-	return nil
+	return err
+}
+
+// unlock releases the lock on the log's directory, if the log holds it.
+func (l *Log) unlock() error {
+	if l.lock == nil {
+		return nil
+	}
+	err := unlockDir(l.lock)
+	l.lock = nil
+	return err
 }
 
-// Remove erases the log contents by removing all its segment files.
+// Remove erases the log contents by removing all its segment files. The directory stays locked until it is
+// removed.
 func (l *Log) Remove() error {
-	if err := l.Close(); err != nil {
-		return err
+	if l.Config.ReadOnly {
+		return ErrReadOnly
 	}
-	return os.RemoveAll(l.Dir)
+	l.setOpen(false)
+	l.stop()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// the segments' files are removed whether or not they close cleanly
+	err := l.closeSegments()
+	if rerr := os.RemoveAll(l.Dir); err == nil {
+		err = rerr
+	}
+	if uerr := l.unlock(); err == nil {
+		err = uerr
+	}
+	return err
 }
 
-// Reset removes the current log contents and sets up a new log.
+// Reset removes the current log contents and sets up a new log. The directory stays locked throughout, so that
+// no other Log opens it half reset. If the reset fails, the log is left without segments and its methods return
+// ErrNotOpen until a Reset succeeds.
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	l.setOpen(false)
+	l.stop()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// the segments' files are removed, so an error closing them does not matter
+	_ = l.closeSegments()
+	l.segments, l.activeSegment = nil, nil
+	err := l.removeContents()
+	if err == nil {
+		err = l.setup()
+	}
+	if err != nil {
+		_ = l.closeSegments()
+		l.segments, l.activeSegment = nil, nil
+		return err
+	}
+	l.start()
+	l.setOpen(true)
+	return nil
+}
+
+// removeContents removes everything in the log's directory but the lock file.
+func (l *Log) removeContents() error {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
 		return err
 	}
-	return l.setup()
+	for _, file := range files {
+		name := path.Join(l.Dir, file.Name())
+		switch {
+		case file.Name() == lockFileName:
+		case file.IsDir():
+			err = os.RemoveAll(name)
+		default:
+			err = l.Config.fs().Remove(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MaxRecordBytes returns the size limit of the log's marshaled records, zero if there is none.
+func (l *Log) MaxRecordBytes() uint64 {
+	return l.Config.Limits.MaxRecordBytes
 }
 
 // LowestOffset returns the lowest offset for the records stored in the log.
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
 	return l.segments[0].baseOffset, nil
 }
 
@@ -154,6 +566,9 @@ func (l *Log) LowestOffset() (uint64, error) {
 func (l *Log) HighestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
 	off := l.segments[len(l.segments)-1].nextOffset
 	if off == 0 {
 		return off, nil
@@ -161,23 +576,91 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
-// Truncate removes all segments whose highest offset is lower than or equal to the lowest.
+// Truncate removes all sealed segments whose highest offset is lower than or equal to the lowest.
 // It will be called periodically to clear disc space by removing old segments.
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	var segments []*segment
-	for _, segment := range l.segments {
-		if segment.nextOffset <= lowest+1 {
-			if err := segment.Remove(); err != nil {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	n := 0
+	for n < len(l.segments)-1 && l.segments[n].nextOffset <= lowest+1 {
+		n++
+	}
+	return l.removeFront(n)
+}
+
+// removeFront removes the first n segments of the log, after adding their records to the producer snapshot.
+func (l *Log) removeFront(n int) error {
+	if err := l.snapshotProducers(l.segments[:n]); err != nil {
+		return err
+	}
+	for ; n > 0; n-- {
+		if err := l.removeSegment(l.segments[0]); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	l.pruneTxns()
+	return nil
+}
+
+// TruncateAfter removes all records whose offset is greater than the given offset, so that the next record
+// appended to the log gets offset+1. Segments which only hold later records are removed and the segment
+// holding the offset is cut after it.
+// It is used to reconcile a replica with a new leader and to roll back unwanted appends.
+func (l *Log) TruncateAfter(offset uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	if offset == math.MaxUint64 {
+		return nil
+	}
+	return l.truncateFrom(offset + 1)
+}
+
+// truncateFrom removes all records whose offset is greater than or equal to the given offset, so that the next
+// record appended to the log gets that offset, and rebuilds the log's in-memory state without them.
+func (l *Log) truncateFrom(next uint64) error {
+	if err := l.cut(next, l.removeSegment); err != nil {
+		return err
+	}
+	l.emitRecover()
+	return nil
+}
+
+// cut removes all records whose offset is greater than or equal to the given offset, removing the segments
+// which only hold such records with remove, and rebuilds the log's in-memory state without them.
+func (l *Log) cut(next uint64, remove func(*segment) error) error {
+	for len(l.segments) > 0 {
+		seg := l.segments[len(l.segments)-1]
+		if seg.baseOffset < next {
+			if err := seg.TruncateAfter(next - 1); err != nil {
 				return err
 			}
-			continue
+			break
 		}
-		segments = append(segments, segment)
+		if err := remove(seg); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
 	}
-	l.segments = segments
-	return nil
+	if len(l.segments) == 0 || l.segments[len(l.segments)-1].IsMaxed() {
+		if err := l.newSegment(next); err != nil {
+			return err
+		}
+	}
+	l.activeSegment = l.segments[len(l.segments)-1]
+	return l.loadState()
 }
 
 // Reader returns an io.Reader to read the whole log.
@@ -1,9 +1,16 @@
 package log
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"path"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	api "github.com/kartpop/dclog/api/v1"
@@ -19,6 +26,36 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"idempotent producer":               testIdempotentProducer,
+		"producer expiration":               testProducerExpiration,
+		"read committed transactions":       testReadCommitted,
+		"transaction timeout":               testTxnTimeout,
+		"truncate after":                    testTruncateAfter,
+		"read-only open":                    testReadOnly,
+		"directory lock":                    testDirLock,
+		"failed reset":                      testFailedReset,
+		"space limits":                      testSpaceLimits,
+		"record expiry":                     testExpiry,
+		"record expiry in transactions":     testExpiryTxn,
+		"merge segments":                    testMergeSegments,
+		"merge truncated run":               testMergeTruncatedRun,
+		"lookup key":                        testLookupKey,
+		"scrub segments":                    testScrub,
+		"scrub middle segment":              testScrubMiddleSegment,
+		"scrub last sealed segment":         testScrubLastSealedSegment,
+		"scrub quarantine keeps state":      testScrubQuarantineState,
+		"scrub large segment":               testScrubLargeSegment,
+		"record size limit":                 testRecordSizeLimit,
+		"stats":                             testStats,
+		"lifecycle hooks":                   testHooks,
+		"tail cache":                        testTailCache,
+		"scan segment files":                testScanSegment,
+		"offline repair":                    testRepair,
+		"repair beyond index capacity":      testRepairIndexCapacity,
+		"repair keeps gaps":                 testRepairGap,
+		"export and import":                 testExportImport,
+		"append batch":                      testAppendBatch,
+		"readiness":                         testReady,
 	}
 	for scenario, fn := range scenFunc {
 		t.Run(scenario, func(t *testing.T) {
@@ -117,4 +154,1327 @@ func testTruncate(t *testing.T, log *Log) {
 	require.Error(t, err)
 	_, err = log.Read(2)
 	require.NoError(t, err)
+
+	// the active segment is kept
+	require.NoError(t, log.Truncate(100))
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	base, err := log.Roll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), base)
+}
+
+func testIdempotentProducer(t *testing.T, log *Log) {
+	for seq := uint64(1); seq <= 3; seq++ {
+		off, err := log.Append(&api.Record{Value: []byte("hello world"), ProducerId: 7, Sequence: seq})
+		require.NoError(t, err)
+		require.Equal(t, seq-1, off)
+	}
+
+	// a retried sequence returns the original offset without appending
+	off, err := log.Append(&api.Record{Value: []byte("hello world"), ProducerId: 7, Sequence: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	// a gap in the sequence is rejected
+	_, err = log.Append(&api.Record{Value: []byte("hello world"), ProducerId: 7, Sequence: 5})
+	require.Equal(t, api.ErrorOutOfOrderSequence{ProducerID: 7, Sequence: 5, Expected: 4}, err)
+
+	// producer state survives a restart
+	require.NoError(t, log.Close())
+	reopenedLog, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	off, err = reopenedLog.Append(&api.Record{Value: []byte("hello world"), ProducerId: 7, Sequence: 3})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = reopenedLog.Append(&api.Record{Value: []byte("hello world"), ProducerId: 7, Sequence: 4})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// producer state survives the removal of the producer's records, across restarts and later truncations
+	_, err = reopenedLog.Append(&api.Record{Value: []byte("hello world"), ProducerId: 8, Sequence: 1})
+	require.NoError(t, err)
+	require.NoError(t, reopenedLog.Truncate(3))
+	lowest, err := reopenedLog.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+	require.NoError(t, reopenedLog.Close())
+	reopenedLog, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer reopenedLog.Close()
+	off, err = reopenedLog.Append(&api.Record{Value: []byte("hello world"), ProducerId: 7, Sequence: 4})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, reopenedLog.Truncate(4))
+	require.NoError(t, reopenedLog.TruncateAfter(4))
+	off, err = reopenedLog.Append(&api.Record{Value: []byte("hello world"), ProducerId: 7, Sequence: 4})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	off, err = reopenedLog.Append(&api.Record{Value: []byte("hello world"), ProducerId: 8, Sequence: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	_, err = reopenedLog.Append(&api.Record{Value: []byte("hello world"), ProducerId: 7, Sequence: 6})
+	require.Equal(t, api.ErrorOutOfOrderSequence{ProducerID: 7, Sequence: 6, Expected: 5}, err)
+}
+
+func testProducerExpiration(t *testing.T, log *Log) {
+	log.Config.Producers.Expiration = time.Hour
+	idle := time.Now().Add(-2 * time.Hour).UnixNano()
+	for id := uint64(1); id <= 3; id++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world"), ProducerId: id, Sequence: 1, Timestamp: idle})
+		require.NoError(t, err)
+	}
+	_, err := log.Append(&api.Record{Value: []byte("hello world"), ProducerId: 4, Sequence: 1})
+	require.NoError(t, err)
+	require.NoError(t, log.Truncate(3))
+
+	// only the producer which appended within the expiration is kept
+	fi, err := os.Stat(path.Join(log.Dir, producerSnapshotFile))
+	require.NoError(t, err)
+	require.Equal(t, int64(lenWidth+snapshotWidth), fi.Size())
+	require.Len(t, log.producers, 1)
+	require.NoError(t, log.Close())
+	reopenedLog, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer reopenedLog.Close()
+	require.Len(t, reopenedLog.producers, 1)
+
+	// a retry from an expired producer is appended again, while a retry from a live one is not
+	off, err := reopenedLog.Append(&api.Record{Value: []byte("hello world"), ProducerId: 1, Sequence: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	off, err = reopenedLog.Append(&api.Record{Value: []byte("hello world"), ProducerId: 4, Sequence: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func testReadCommitted(t *testing.T, log *Log) {
+	committed, err := log.BeginTxn()
+	require.NoError(t, err)
+	aborted, err := log.BeginTxn()
+	require.NoError(t, err)
+	require.NotEqual(t, committed, aborted)
+
+	_, err = log.Append(&api.Record{Value: []byte("aborted"), TxnId: aborted})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("committed"), TxnId: committed})
+	require.NoError(t, err)
+	_, err = log.AbortTxn(aborted)
+	require.NoError(t, err)
+
+	// records of the open transaction are not visible yet
+	_, err = log.ReadCommitted(0)
+	require.Equal(t, api.ErrorOffsetOutOfRange{Offset: 0}, err)
+
+	_, err = log.CommitTxn(committed)
+	require.NoError(t, err)
+	record, err := log.ReadCommitted(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("committed"), record.Value)
+
+	// appending to an ended transaction fails
+	_, err = log.Append(&api.Record{Value: []byte("late"), TxnId: committed})
+	require.Equal(t, api.ErrorTxnNotOpen{TxnID: committed}, err)
+
+	// transaction state survives a restart
+	require.NoError(t, log.Close())
+	reopenedLog, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	record, err = reopenedLog.ReadCommitted(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("committed"), record.Value)
+	_, err = reopenedLog.ReadCommitted(record.Offset + 1)
+	require.Error(t, err)
+	id, err := reopenedLog.BeginTxn()
+	require.NoError(t, err)
+	require.Greater(t, id, aborted)
+}
+
+func testTxnTimeout(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	c := log.Config
+	c.Txn.Timeout = 20 * time.Millisecond
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	committed, err := log.BeginTxn()
+	require.NoError(t, err)
+	_, err = log.CommitTxn(committed)
+	require.NoError(t, err)
+	abandoned, err := log.BeginTxn()
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("abandoned"), TxnId: abandoned})
+	require.NoError(t, err)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// the abandoned transaction is aborted, so that the records after it become visible
+	require.Eventually(t, func() bool {
+		record, err := log.ReadCommitted(0)
+		return err == nil && record.Offset == off
+	}, time.Second, 10*time.Millisecond)
+	_, err = log.CommitTxn(abandoned)
+	require.Equal(t, api.ErrorTxnNotOpen{TxnID: abandoned}, err)
+
+	// ended transactions are forgotten once none of their records is left
+	log.mu.RLock()
+	require.NotContains(t, log.txns, committed)
+	require.Contains(t, log.txns, abandoned)
+	log.mu.RUnlock()
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.NoError(t, log.Truncate(highest))
+	log.mu.RLock()
+	require.NotContains(t, log.txns, abandoned)
+	log.mu.RUnlock()
+}
+
+func testTruncateAfter(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.TruncateAfter(2))
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	_, err = log.Read(3)
+	require.Error(t, err)
+	_, err = log.Read(2)
+	require.NoError(t, err)
+
+	// records appended after the truncation reuse the discarded offsets
+	append = &api.Record{
+		Value: []byte("bye"),
+	}
+	off, err = log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	require.NoError(t, log.Close())
+	reopenedLog, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	read, err := reopenedLog.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+	_, err = reopenedLog.Read(4)
+	require.Error(t, err)
+}
+
+func testReadOnly(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	for i := uint64(0); i < 3; i++ {
+		_, err := log.Read(i) // flushes the segment's buffered writes
+		require.NoError(t, err)
+	}
+
+	// a live log can be inspected
+	c := log.Config
+	c.ReadOnly = true
+	readOnlyLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	off, err := readOnlyLog.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	for i := uint64(0); i < 3; i++ {
+		read, err := readOnlyLog.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, append.Value, read.Value)
+	}
+	_, err = readOnlyLog.Append(append)
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, readOnlyLog.Truncate(0))
+	require.Equal(t, ErrReadOnly, readOnlyLog.TruncateAfter(0))
+	require.NoError(t, readOnlyLog.Close())
+
+	// the files of the inspected log are left untouched
+	before, err := ioutil.ReadDir(log.Dir)
+	require.NoError(t, err)
+	readOnlyLog, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	require.NoError(t, readOnlyLog.Close())
+	after, err := ioutil.ReadDir(log.Dir)
+	require.NoError(t, err)
+	require.Equal(t, len(before), len(after))
+	for i := range before {
+		require.Equal(t, before[i].Size(), after[i].Size())
+	}
+
+	// a read-only log is never created
+	dir, err := ioutil.TempDir("", "read-only-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+}
+
+func testDirLock(t *testing.T, log *Log) {
+	_, err := NewLog(log.Dir, log.Config)
+	require.True(t, errors.Is(err, ErrLocked))
+
+	// read-only opens do not need the lock
+	c := log.Config
+	c.ReadOnly = true
+	readOnlyLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	require.NoError(t, readOnlyLog.Close())
+
+	// the lock is released on close and retaken on reset
+	require.NoError(t, log.Close())
+	reopenedLog, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.NoError(t, reopenedLog.Reset())
+	_, err = NewLog(log.Dir, log.Config)
+	require.True(t, errors.Is(err, ErrLocked))
+	require.NoError(t, reopenedLog.Remove())
+}
+
+// openFailFS is the operating system's filesystem, failing to open files while fail is set.
+type openFailFS struct {
+	osFS
+	fail bool
+}
+
+func (fs *openFailFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if fs.fail {
+		return nil, errors.New("open failed")
+	}
+	return fs.osFS.OpenFile(name, flag, perm)
+}
+
+func testFailedReset(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	fs := &openFailFS{}
+	c := log.Config
+	c.FS = fs
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// the log is left without segments, but keeps its directory locked
+	fs.fail = true
+	require.Error(t, log.Reset())
+	_, err = log.LowestOffset()
+	require.Equal(t, ErrNotOpen, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrNotOpen, err)
+	_, err = log.ReadCommitted(0)
+	require.Equal(t, ErrNotOpen, err)
+	require.True(t, errors.Is(log.Ready(), ErrNotOpen))
+	_, err = NewLog(log.Dir, log.Config)
+	require.True(t, errors.Is(err, ErrLocked))
+
+	// a later reset recovers it
+	fs.fail = false
+	require.NoError(t, log.Reset())
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.NoError(t, log.Ready())
+	require.NoError(t, log.Close())
+}
+
+func testSpaceLimits(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	_, err := log.Append(append)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// the quota is reached
+	c := log.Config
+	c.Limits.MaxLogBytes = log.size() + 1
+	quotaLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	_, err = quotaLog.Append(append)
+	_, ok := err.(api.ErrorResourceExhausted)
+	require.True(t, ok)
+	_, err = quotaLog.Read(0) // reads are still served
+	require.NoError(t, err)
+	require.NoError(t, quotaLog.Close())
+
+	// the free space floor is larger than any disk
+	c = log.Config
+	c.Limits.MinFreeBytes = 1 << 62
+	floorLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	_, err = floorLog.Append(append)
+	_, ok = err.(api.ErrorResourceExhausted)
+	require.True(t, ok)
+	off, err := floorLog.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.NoError(t, floorLog.Close())
+}
+
+func testExpiry(t *testing.T, log *Log) {
+	expiring := &api.Record{
+		Value:     []byte("hello world"),
+		ExpiresAt: time.Now().Add(50 * time.Millisecond).UnixNano(),
+	}
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(expiring)
+		require.NoError(t, err)
+	}
+	persistent := &api.Record{
+		Value: []byte("hello world"),
+	}
+	_, err := log.Append(persistent)
+	require.NoError(t, err)
+	_, err = log.Read(0)
+	require.NoError(t, err)
+
+	// expired records are reported
+	require.Eventually(t, func() bool {
+		_, err := log.Read(0)
+		return err == api.ErrorRecordExpired{Offset: 0}
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, log.Close())
+
+	// segments whose records have all expired are removed by the background cleanup
+	c := log.Config
+	c.Expiry.CleanupInterval = 10 * time.Millisecond
+	expiryLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer expiryLog.Close()
+	require.Eventually(t, func() bool {
+		off, err := expiryLog.LowestOffset()
+		return err == nil && off == 2
+	}, time.Second, 10*time.Millisecond)
+	read, err := expiryLog.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, persistent.Value, read.Value)
+}
+
+func testExpiryTxn(t *testing.T, log *Log) {
+	// every record is rolled into a segment of its own
+	roll := func(off uint64, err error) uint64 {
+		require.NoError(t, err)
+		_, err = log.Roll()
+		require.NoError(t, err)
+		return off
+	}
+	expiring := func(txn uint64) *api.Record {
+		return &api.Record{Value: []byte("hello world"), ExpiresAt: time.Now().UnixNano(), TxnId: txn}
+	}
+	committed := roll(log.BeginTxn())
+	roll(log.Append(expiring(committed)))
+	roll(log.CommitTxn(committed))
+	open := roll(log.BeginTxn())
+	begin, err := log.HighestOffset()
+	require.NoError(t, err)
+	roll(log.Append(expiring(open)))
+	roll(log.Append(&api.Record{Value: []byte("hello world")}))
+
+	// the markers of the committed transaction do not keep its segments, those of the open one are kept
+	require.NoError(t, log.RemoveExpired())
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, begin, lowest)
+
+	roll(log.CommitTxn(open))
+	require.NoError(t, log.RemoveExpired())
+	lowest, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, begin+2, lowest)
+}
+
+func testMergeSegments(t *testing.T, log *Log) {
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+	n := len(log.segments)
+	require.NoError(t, log.Close())
+
+	// with larger limits, the small sealed segments are merged in the background
+	c := log.Config
+	c.Segment.MaxStoreBytes = 1024
+	c.Merge.Interval = 10 * time.Millisecond
+	mergedLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	deleted := make(chan [2]uint64, n)
+	mergedLog.OnSegmentDeleted(func(base, next uint64) { deleted <- [2]uint64{base, next} })
+	appended := make(chan uint64, 1)
+	mergedLog.OnAppend(func(offset uint64) { appended <- offset })
+	require.Eventually(t, func() bool {
+		mergedLog.mu.RLock()
+		defer mergedLog.mu.RUnlock()
+		return len(mergedLog.segments) == 2
+	}, time.Second, 10*time.Millisecond)
+	for i := uint64(0); i < 6; i++ {
+		read, err := mergedLog.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), read.Value)
+	}
+	off, err := mergedLog.Append(&api.Record{Value: []byte("record 6")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	// the hooks are called in order, so once the append is delivered, a deletion by the merge would have been;
+	// the merged segments' records remain in the log and are not reported as deleted
+	require.Equal(t, uint64(6), <-appended)
+	require.Len(t, deleted, 0)
+	require.NoError(t, mergedLog.Close())
+
+	files, err := ioutil.ReadDir(log.Dir)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(files)) // two segments and the lock file
+	reopenedLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer reopenedLog.Close()
+	for i := uint64(0); i < 7; i++ {
+		read, err := reopenedLog.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), read.Value)
+	}
+}
+
+func testMergeTruncatedRun(t *testing.T, log *Log) {
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+	c := log.Config
+	c.Segment.MaxStoreBytes = 1024
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// a run truncated while its merged segment is written is left as it is
+	runs := log.mergeRuns()
+	require.Len(t, runs, 1)
+	require.NoError(t, log.Truncate(1))
+	n := len(log.segments)
+	require.NoError(t, log.merge(runs[0]))
+	require.Len(t, log.segments, n)
+	_, err = os.Stat(segmentPath(log.Dir, 0, ".store"+mergeExt))
+	require.True(t, os.IsNotExist(err))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	for i := lowest; i < 6; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), read.Value)
+	}
+}
+
+func testLookupKey(t *testing.T, log *Log) {
+	for i := 0; i < 6; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i%3))
+		_, err := log.Append(&api.Record{Key: key, Value: []byte(fmt.Sprintf("v%d", i))})
+		require.NoError(t, err)
+	}
+	_, err := log.Append(&api.Record{Key: []byte("key-0"), Value: []byte("latest")})
+	require.NoError(t, err)
+
+	check := func(log *Log) {
+		read, err := log.LookupKey([]byte("key-0"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("latest"), read.Value)
+		require.Equal(t, uint64(6), read.Offset)
+		read, err = log.LookupKey([]byte("key-2"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("v5"), read.Value) // found in a sealed segment
+		_, err = log.LookupKey([]byte("key-3"))
+		require.Equal(t, api.ErrorKeyNotFound{Key: []byte("key-3")}, err)
+	}
+	check(log)
+
+	// the key indexes are rebuilt on startup
+	require.NoError(t, log.Close())
+	reopenedLog, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer reopenedLog.Close()
+	check(reopenedLog)
+
+	// records of open and aborted transactions are skipped, those of committed ones are found
+	aborted, err := reopenedLog.BeginTxn()
+	require.NoError(t, err)
+	_, err = reopenedLog.Append(&api.Record{Key: []byte("key-0"), Value: []byte("aborted"), TxnId: aborted})
+	require.NoError(t, err)
+	committed, err := reopenedLog.BeginTxn()
+	require.NoError(t, err)
+	_, err = reopenedLog.Append(&api.Record{Key: []byte("key-2"), Value: []byte("committed"), TxnId: committed})
+	require.NoError(t, err)
+	check(reopenedLog)
+	_, err = reopenedLog.AbortTxn(aborted)
+	require.NoError(t, err)
+	_, err = reopenedLog.CommitTxn(committed)
+	require.NoError(t, err)
+	read, err := reopenedLog.LookupKey([]byte("key-0"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("latest"), read.Value)
+	read, err = reopenedLog.LookupKey([]byte("key-2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("committed"), read.Value)
+}
+
+func testScrub(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	corruptions, err := log.Scrub()
+	require.NoError(t, err)
+	require.Empty(t, corruptions)
+	sealed := log.segments[:len(log.segments)-1]
+	require.Equal(t, uint64(len(sealed)), log.ScrubMetrics().SegmentsScrubbed)
+	require.Equal(t, sealed[len(sealed)-1].nextOffset, log.ScrubMetrics().RecordsScrubbed)
+	require.NoError(t, log.Close())
+
+	// flip a byte of the first record's value
+	storePath := path.Join(log.Dir, "0.store")
+	b, err := ioutil.ReadFile(storePath)
+	require.NoError(t, err)
+	b[lenWidth+2] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(storePath, b, 0644))
+
+	found := make(chan *CorruptionError, 1)
+	c := log.Config
+	c.Scrub.Interval = 10 * time.Millisecond
+	c.Scrub.Quarantine = true
+	c.Scrub.OnCorrupt = func(e *CorruptionError) {
+		found <- e
+	}
+	scrubbedLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer scrubbedLog.Close()
+	select {
+	case corruption := <-found:
+		require.Equal(t, uint64(0), corruption.BaseOffset)
+		require.Equal(t, uint64(0), corruption.Offset)
+		require.True(t, corruption.Quarantined)
+	case <-time.After(time.Second):
+		t.Fatal("corruption was not reported")
+	}
+	_, err = scrubbedLog.Read(0)
+	require.Error(t, err)
+	_, err = scrubbedLog.Read(2)
+	require.NoError(t, err)
+	_, err = os.Stat(path.Join(log.Dir, quarantineDir, "0.store"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), scrubbedLog.ScrubMetrics().QuarantinedSegments)
+}
+
+func testScrubLastSealedSegment(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	sealed := log.segments[len(log.segments)-2]
+	base, next := sealed.baseOffset, sealed.nextOffset
+	require.Equal(t, next, log.activeSegment.baseOffset)
+	require.Equal(t, log.activeSegment.baseOffset, log.activeSegment.nextOffset)
+	require.NoError(t, log.Close())
+
+	// flip a byte of the last sealed segment, which is followed by the empty active segment
+	storePath := segmentPath(log.Dir, base, ".store")
+	b, err := ioutil.ReadFile(storePath)
+	require.NoError(t, err)
+	b[lenWidth+2] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(storePath, b, 0644))
+	c := log.Config
+	c.Scrub.Quarantine = true
+	scrubbedLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	corruptions, err := scrubbedLog.Scrub()
+	require.NoError(t, err)
+	require.Len(t, corruptions, 1)
+	require.True(t, corruptions[0].Quarantined)
+	require.NoError(t, scrubbedLog.Close())
+
+	// the quarantined offsets are not handed out again once the log is reopened
+	reopenedLog, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer reopenedLog.Close()
+	off, err := reopenedLog.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, off, next)
+}
+
+func testScrubQuarantineState(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	c := log.Config
+	c.Segment.MaxStoreBytes = 1024
+	c.FS = NewFaultFS(1)
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	// segment 0 holds the producer's record and a record which gets damaged, segment 2 an intact record
+	_, err = log.Append(&api.Record{Value: []byte("hello world"), ProducerId: 7})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = log.Roll()
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = log.Roll()
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	storePath := segmentPath(log.Dir, 0, ".store")
+	b, err := ioutil.ReadFile(storePath)
+	require.NoError(t, err)
+	b[lenWidth+enc.Uint64(b)+lenWidth+2] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(storePath, b, 0644))
+	c.Scrub.Quarantine = true
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	corruptions, err := log.Scrub()
+	require.NoError(t, err)
+	require.Len(t, corruptions, 1)
+	require.Equal(t, uint64(1), corruptions[0].Offset)
+	require.True(t, corruptions[0].Quarantined)
+	// only the records up to the damaged one are counted as verified
+	require.Equal(t, uint64(2), log.ScrubMetrics().RecordsScrubbed)
+	require.NoError(t, log.Close())
+
+	// a retry of the producer's record is still recognized once the log is reopened
+	c.Scrub.Quarantine = false
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.Append(&api.Record{Value: []byte("hello world"), ProducerId: 7})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+}
+
+func testScrubMiddleSegment(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// flip a byte of the third record's value, which is alone in its segment
+	storePath := path.Join(log.Dir, "2.store")
+	b, err := ioutil.ReadFile(storePath)
+	require.NoError(t, err)
+	b[lenWidth+2] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(storePath, b, 0644))
+	// a file quarantined earlier is kept
+	require.NoError(t, os.MkdirAll(path.Join(log.Dir, quarantineDir), 0755))
+	earlier := path.Join(log.Dir, quarantineDir, "2.store")
+	require.NoError(t, ioutil.WriteFile(earlier, []byte("earlier"), 0644))
+
+	c := log.Config
+	c.Scrub.Quarantine = true
+	scrubbedLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer scrubbedLog.Close()
+	corruptions, err := scrubbedLog.Scrub()
+	require.NoError(t, err)
+	require.Len(t, corruptions, 1)
+	require.Equal(t, uint64(2), corruptions[0].BaseOffset)
+	require.True(t, corruptions[0].Quarantined)
+	b, err = ioutil.ReadFile(earlier)
+	require.NoError(t, err)
+	require.Equal(t, []byte("earlier"), b)
+	_, err = os.Stat(earlier + ".1")
+	require.NoError(t, err)
+
+	// consumers skip the gap the quarantined segment left
+	_, err = scrubbedLog.Read(2)
+	require.Equal(t, api.ErrorOffsetOutOfRange{Offset: 2}, err)
+	require.Equal(t, uint64(3), scrubbedLog.SkipGap(2))
+	require.Equal(t, uint64(1), scrubbedLog.SkipGap(1))
+	record, err := scrubbedLog.ReadCommitted(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), record.Offset)
+}
+
+func testScrubLargeSegment(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	c := log.Config
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	n := 2*scrubChunk + 1
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err = log.Roll()
+	require.NoError(t, err)
+
+	// the segment is verified a chunk of records at a time
+	corruptions, err := log.Scrub()
+	require.NoError(t, err)
+	require.Empty(t, corruptions)
+	require.Equal(t, uint64(n), log.ScrubMetrics().RecordsScrubbed)
+}
+
+func testRecordSizeLimit(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	c := log.Config
+	c.Limits.MaxRecordBytes = 32
+	limitedLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer limitedLog.Close()
+
+	_, err = limitedLog.Append(&api.Record{Value: make([]byte, 64)})
+	apiErr, ok := err.(api.ErrorRecordTooLarge)
+	require.True(t, ok)
+	require.Equal(t, uint64(32), apiErr.Max)
+	require.Greater(t, apiErr.Size, uint64(64))
+	off, err := limitedLog.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func testStats(t *testing.T, log *Log) {
+	before := time.Now().UnixNano()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	stats := log.Stats()
+	require.Equal(t, len(log.segments), stats.SegmentCount)
+	require.Equal(t, stats.SegmentCount, len(stats.Segments))
+
+	var total, pending uint64
+	for i, s := range stats.Segments {
+		require.Equal(t, i != len(stats.Segments)-1, s.Sealed)
+		require.Equal(t, log.segments[i].baseOffset, s.BaseOffset)
+		require.Equal(t, log.segments[i].nextOffset, s.NextOffset)
+		if s.NextOffset > s.BaseOffset {
+			require.GreaterOrEqual(t, s.OldestTimestamp, before)
+			require.GreaterOrEqual(t, s.NewestTimestamp, s.OldestTimestamp)
+		}
+		total += s.StoreBytes + s.IndexBytes
+		pending += s.PendingBytes
+	}
+	require.Equal(t, total, stats.TotalBytes)
+	require.Equal(t, pending, stats.PendingBytes)
+	require.NotZero(t, stats.PendingBytes) // nothing has been read, so appends are still buffered
+
+	_, err := log.Read(0)
+	require.NoError(t, err)
+	require.Less(t, log.Stats().PendingBytes, stats.PendingBytes)
+}
+
+func testHooks(t *testing.T, log *Log) {
+	appended := make(chan uint64, 8)
+	rolled := make(chan [2]uint64, 8)
+	deleted := make(chan [2]uint64, 8)
+	recovered := make(chan RecoverInfo, 8)
+	log.OnAppend(func(offset uint64) { appended <- offset })
+	log.OnSegmentRolled(func(base, next uint64) { rolled <- [2]uint64{base, next} })
+	log.OnSegmentDeleted(func(base, next uint64) { deleted <- [2]uint64{base, next} })
+	log.OnRecover(func(info RecoverInfo) { recovered <- info })
+	receive := func(c interface{}) interface{} {
+		t.Helper()
+		switch c := c.(type) {
+		case chan uint64:
+			select {
+			case v := <-c:
+				return v
+			case <-time.After(time.Second):
+			}
+		case chan [2]uint64:
+			select {
+			case v := <-c:
+				return v
+			case <-time.After(time.Second):
+			}
+		case chan RecoverInfo:
+			select {
+			case v := <-c:
+				return v
+			case <-time.After(time.Second):
+			}
+		}
+		t.Fatal("hook was not called")
+		return nil
+	}
+
+	// registering OnRecover replays the recovery done when the log was opened
+	require.Equal(t, RecoverInfo{Segments: 1, LowestOffset: 0, NextOffset: 0}, receive(recovered))
+
+	for i := uint64(0); i < 2; i++ {
+		off, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, i, receive(appended))
+		require.Equal(t, [2]uint64{off, off + 1}, receive(rolled))
+	}
+
+	require.NoError(t, log.Truncate(0))
+	require.Equal(t, [2]uint64{0, 1}, receive(deleted))
+
+	require.NoError(t, log.TruncateAfter(1))
+	require.Equal(t, RecoverInfo{Segments: 2, LowestOffset: 1, NextOffset: 2}, receive(recovered))
+	require.Zero(t, log.HooksDropped())
+}
+
+func testTailCache(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	c := log.Config
+	c.Segment.MaxStoreBytes = 1024
+	c.Cache.TailRecords = 2
+	cachedLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer cachedLog.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err = cachedLog.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	buffered := cachedLog.activeSegment.store.Buffered()
+	for off := uint64(1); off < 3; off++ {
+		record, err := cachedLog.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+	}
+	require.Equal(t, buffered, cachedLog.activeSegment.store.Buffered()) // served without flushing
+
+	record, err := cachedLog.Read(0) // evicted from the cache
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 0"), record.Value)
+	require.Zero(t, cachedLog.activeSegment.store.Buffered())
+
+	require.NoError(t, cachedLog.TruncateAfter(1))
+	_, err = cachedLog.Read(2)
+	require.Error(t, err)
+	off, err := cachedLog.Append(&api.Record{Value: []byte("replaced")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	record, err = cachedLog.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("replaced"), record.Value)
+}
+
+func testScanSegment(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	c := log.Config
+	c.Segment.MaxStoreBytes = 1024
+	bigLog, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = bigLog.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, bigLog.Close())
+
+	// flip a byte of the second record's value and leave bytes at the end of the store which are not indexed
+	storePath, indexPath := path.Join(log.Dir, "0.store"), path.Join(log.Dir, "0.index")
+	b, err := ioutil.ReadFile(storePath)
+	require.NoError(t, err)
+	first := enc.Uint64(b)
+	b[lenWidth+first+lenWidth+2] ^= 0xff
+	b = append(b, 1, 2, 3)
+	require.NoError(t, ioutil.WriteFile(storePath, b, 0644))
+
+	var entries []SegmentEntry
+	summary, err := ScanSegment(storePath, indexPath, func(e SegmentEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), summary.Entries)
+	require.Equal(t, uint64(3), summary.UnindexedBytes)
+	require.Len(t, entries, 2)
+	require.Equal(t, uint64(0), entries[0].Position)
+	require.Equal(t, first, entries[0].Length)
+	require.Equal(t, ChecksumOK, entries[0].Checksum)
+	require.Equal(t, uint64(1), entries[1].Offset)
+	require.Equal(t, lenWidth+first, entries[1].Position)
+	require.NoError(t, entries[1].Err)
+	require.Equal(t, ChecksumMismatch, entries[1].Checksum)
+
+	// the zeroed index of an empty segment, as left by a crash, has no entry
+	require.NoError(t, ioutil.WriteFile(storePath, nil, 0644))
+	require.NoError(t, ioutil.WriteFile(indexPath, make([]byte, 10*entWidth), 0644))
+	entries = nil
+	summary, err = ScanSegment(storePath, indexPath, func(e SegmentEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), summary.Entries)
+	require.Empty(t, entries)
+}
+
+func testRepair(t *testing.T, log *Log) {
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+	dir := log.Dir
+
+	// tear the records of segments 1 and 3, which leaves segment 4 behind as if its roll was lost, remove the
+	// index of segment 2 and leave an orphan index and the file of an interrupted merge
+	require.NoError(t, os.Truncate(segmentPath(dir, 1, ".store"), 10))
+	require.NoError(t, os.Truncate(segmentPath(dir, 3, ".store"), 5))
+	require.NoError(t, os.Remove(segmentPath(dir, 2, ".index")))
+	b, err := ioutil.ReadFile(segmentPath(dir, 0, ".index"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(segmentPath(dir, 100, ".index"), b, 0644))
+	require.NoError(t, ioutil.WriteFile(segmentPath(dir, 0, ".store"+mergeExt), nil, 0644))
+
+	plan, err := PlanRepair(dir, log.Config)
+	require.NoError(t, err)
+	planned := map[uint64]RepairKind{}
+	for _, action := range plan {
+		if path.Ext(action.Files[0]) != mergeExt {
+			planned[action.BaseOffset] = action.Kind
+		}
+	}
+	require.Len(t, plan, 6)
+	require.Equal(t, map[uint64]RepairKind{
+		1: RepairRecover, 2: RepairRecover, 3: RepairRecover, 4: RepairRemove, 100: RepairQuarantine,
+	}, planned)
+
+	lock, err := lockDir(dir)
+	require.NoError(t, err)
+	require.True(t, errors.Is(Repair(dir, log.Config, plan), ErrLocked))
+	require.NoError(t, unlockDir(lock))
+
+	// a plan which no longer matches the directory is not applied
+	stale := append([]RepairAction{}, plan...)
+	require.NoError(t, os.Remove(segmentPath(dir, 0, ".store"+mergeExt)))
+	require.True(t, errors.Is(Repair(dir, log.Config, stale), ErrPlanChanged))
+	_, err = os.Stat(segmentPath(dir, 100, ".index"))
+	require.NoError(t, err)
+	plan, err = PlanRepair(dir, log.Config)
+	require.NoError(t, err)
+	require.Len(t, plan, 5)
+
+	require.NoError(t, Repair(dir, log.Config, plan))
+	plan, err = PlanRepair(dir, log.Config)
+	require.NoError(t, err)
+	require.Empty(t, plan)
+	_, err = os.Stat(path.Join(dir, quarantineDir, "100.index"))
+	require.NoError(t, err)
+
+	log, err = NewLog(dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	for _, off := range []uint64{0, 2} {
+		_, err = log.Read(off)
+		require.NoError(t, err)
+	}
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func testRepairGap(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err := log.appendAt(&api.Record{Value: []byte("after gap")}, 10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), log.activeSegment.baseOffset)
+	require.NoError(t, log.Close())
+	dir := log.Dir
+
+	// a crash loses the record after the gap, which leaves both segment 10, following the gap, and segment 11,
+	// whose roll was lost, empty
+	require.NoError(t, os.Truncate(segmentPath(dir, 10, ".store"), 0))
+	require.NoError(t, os.Truncate(segmentPath(dir, 10, ".index"), 0))
+	plan, err := PlanRepair(dir, log.Config)
+	require.NoError(t, err)
+	var removed []uint64
+	for _, action := range plan {
+		if action.Kind == RepairRemove {
+			removed = append(removed, action.BaseOffset)
+		}
+	}
+	require.Equal(t, []uint64{11}, removed)
+	require.NoError(t, Repair(dir, log.Config, plan))
+
+	log, err = NewLog(dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+}
+
+func testRepairIndexCapacity(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	dir := log.Dir
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, os.Mkdir(dir, 0755))
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+	storePath := segmentPath(dir, 0, ".store")
+	before, err := ioutil.ReadFile(storePath)
+	require.NoError(t, err)
+
+	// the rebuilt index cannot hold every record, which must not be truncated to fit
+	require.NoError(t, os.Remove(segmentPath(dir, 0, ".index")))
+	c.Segment.MaxIndexBytes = 2 * entWidth
+	_, err = PlanRepair(dir, c)
+	require.Error(t, err)
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+	after, err := ioutil.ReadFile(storePath)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	c.Segment.MaxIndexBytes = 0
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Read(2)
+	require.NoError(t, err)
+}
+
+func testExportImport(t *testing.T, log *Log) {
+	base := time.Now()
+	values := [][]byte{[]byte("hello world"), {0xff, 0xfe, 0x00}, []byte("{\"n\": 2}"), []byte("last")}
+	for i, value := range values {
+		record := &api.Record{
+			Key:       []byte(fmt.Sprintf("key-%d", i)),
+			Value:     value,
+			Timestamp: base.Add(time.Duration(i) * time.Second).UnixNano(),
+		}
+		if i < 2 {
+			record.Headers = map[string][]byte{"content-type": []byte("text/plain")}
+		}
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	// a gap between segments, as left by lost records, is carried over when offsets are preserved
+	require.NoError(t, log.TruncateAfter(2))
+	_, err := log.appendAt(&api.Record{Key: []byte("key-10"), Value: []byte("after gap")}, 10)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	n, err := Export(log, &out, ExportOptions{Encoding: EncodingUTF8})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), n)
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	require.Len(t, lines, 4)
+	require.Contains(t, string(lines[0]), `"headers":{"content-type":"text/plain"}`)
+	require.Contains(t, string(lines[0]), `"value":"hello world","encoding":"utf8"`)
+	require.Contains(t, string(lines[1]), `"headers":{"content-type":"dGV4dC9wbGFpbg=="}`)
+	require.Contains(t, string(lines[1]), `"encoding":"base64"`)
+
+	for _, preserve := range []bool{true, false} {
+		dir, err := ioutil.TempDir("", "import-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		imported, err := NewLog(dir, log.Config)
+		require.NoError(t, err)
+		n, err = Import(imported, bytes.NewReader(out.Bytes()), ImportOptions{PreserveOffsets: preserve})
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), n)
+		offsets := []uint64{0, 1, 2, 10}
+		if !preserve {
+			offsets = []uint64{0, 1, 2, 3}
+		}
+		for i, off := range offsets {
+			record, err := imported.Read(off)
+			require.NoError(t, err)
+			want, err := log.Read([]uint64{0, 1, 2, 10}[i])
+			require.NoError(t, err)
+			require.Equal(t, want.Key, record.Key)
+			require.Equal(t, want.Value, record.Value)
+			require.Equal(t, want.Timestamp, record.Timestamp)
+			require.Equal(t, want.Headers, record.Headers)
+		}
+		require.NoError(t, imported.Close())
+	}
+
+	// records are only imported into an empty log
+	n, err = Import(log, bytes.NewReader(out.Bytes()), ImportOptions{})
+	require.ErrorIs(t, err, ErrNotEmpty)
+	require.Equal(t, uint64(0), n)
+
+	// offset and time ranges
+	out.Reset()
+	to := uint64(2)
+	n, err = Export(log, &out, ExportOptions{From: 1, To: &to})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), n)
+	out.Reset()
+	to = 0
+	n, err = Export(log, &out, ExportOptions{To: &to})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), n)
+	require.Contains(t, out.String(), `"offset":0,`)
+	out.Reset()
+	n, err = Export(log, &out, ExportOptions{Since: base.Add(time.Second), Until: base.Add(2 * time.Second)})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), n)
+	require.Contains(t, out.String(), `"offset":1,`)
+	require.Contains(t, out.String(), `"offset":2,`)
+
+	// a segment which cannot be created at a preserved offset leaves the log as it was
+	require.NoError(t, log.Close())
+	fs := &openFailFS{}
+	c := log.Config
+	c.FS = fs
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	active, err := log.Roll()
+	require.NoError(t, err)
+	require.Equal(t, active, log.activeSegment.nextOffset)
+	fs.fail = true
+	_, err = log.appendAt(&api.Record{Value: []byte("lost")}, 20)
+	require.Error(t, err)
+	fs.fail = false
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), off)
+	off, err = log.appendAt(&api.Record{Value: []byte("after gap")}, 20)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), off)
+	_, err = log.Read(11)
+	require.NoError(t, err)
+
+	// the records held back by an open transaction are reported rather than silently left out
+	txn, err := log.BeginTxn()
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("open"), TxnId: txn})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("held back")})
+	require.NoError(t, err)
+	out.Reset()
+	n, err = Export(log, &out, ExportOptions{From: 11})
+	require.ErrorIs(t, err, ErrOpenTxn)
+	require.Contains(t, err.Error(), "offsets 21 to 23 were not exported")
+	require.Equal(t, uint64(2), n)
+	_, err = log.CommitTxn(txn)
+	require.NoError(t, err)
+	out.Reset()
+	n, err = Export(log, &out, ExportOptions{From: 11})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), n)
+}
+
+func testAppendBatch(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	c := log.Config
+	c.Limits.MaxRecordBytes = 64
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	var appended []uint64
+	var mu sync.Mutex
+	log.OnAppend(func(offset uint64) {
+		mu.Lock()
+		defer mu.Unlock()
+		appended = append(appended, offset)
+	})
+
+	batch := func(producer uint64, values ...string) []*api.Record {
+		records := make([]*api.Record, len(values))
+		for i, v := range values {
+			records[i] = &api.Record{Value: []byte(v), ProducerId: producer, Sequence: uint64(i)}
+		}
+		return records
+	}
+	first, last, err := log.AppendBatch(batch(7, "a", "b", "c"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+	require.Equal(t, uint64(2), last)
+	for off, v := range []string{"a", "b", "c"} {
+		record, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, v, string(record.Value))
+	}
+
+	// a retried batch is not appended again
+	first, last, err = log.AppendBatch(batch(7, "a", "b", "c"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+	require.Equal(t, uint64(2), last)
+
+	// a batch failing part way leaves none of its records, across segments, behind and the hooks are not told
+	records := []*api.Record{{Value: []byte("d")}, {Value: []byte("e")}, {Value: make([]byte, 100)}}
+	_, _, err = log.AppendBatch(records)
+	require.IsType(t, api.ErrorRecordTooLarge{}, err)
+	_, err = log.Read(3)
+	require.Error(t, err)
+	off, err := log.Append(&api.Record{Value: []byte("d")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(appended) == 4
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []uint64{0, 1, 2, 3}, appended)
+
+	// a batch longer than the producer's window of sequences is still recognized when retried
+	values := []string{"e", "f", "g", "h", "i", "j", "k", "l"}
+	first, last, err = log.AppendBatch(batch(9, values...))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), first)
+	require.Equal(t, uint64(11), last)
+	first, last, err = log.AppendBatch(batch(9, values...))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), first)
+	require.Equal(t, uint64(11), last)
+	require.Equal(t, uint64(12), log.activeSegment.nextOffset)
+
+	// a batch of which a prefix was appended, as a crash may leave it, only appends the rest when retried
+	_, err = log.Append(&api.Record{Value: []byte("m"), ProducerId: 10, Sequence: 0})
+	require.NoError(t, err)
+	first, last, err = log.AppendBatch(batch(10, "m", "n"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), first)
+	require.Equal(t, uint64(13), last)
+
+	_, _, err = log.AppendBatch([]*api.Record{{Value: []byte("f"), ProducerId: 8, Sequence: 1}, {Value: []byte("g"), ProducerId: 8, Sequence: 3}})
+	require.IsType(t, api.ErrorOutOfOrderSequence{}, err)
+
+	_, _, err = log.AppendBatch([]*api.Record{{Value: []byte("f"), ProducerId: 8}, {Value: []byte("g"), ProducerId: 11, Sequence: 1}})
+	require.Equal(t, errMixedProducers, err)
+}
+
+func testReady(t *testing.T, log *Log) {
+	require.NoError(t, log.Ready())
+
+	log.Config.Limits.MinFreeBytes = math.MaxUint64
+	require.True(t, errors.Is(log.Ready(), ErrDiskFull))
+	log.Config.Limits.MinFreeBytes = 0
+
+	require.NoError(t, log.Close())
+	require.True(t, errors.Is(log.Ready(), ErrNotOpen))
 }
@@ -0,0 +1,175 @@
+package log
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// MemoryLog is a bounded, in-memory log with the same offset semantics and errors as Log.
+// Records are kept in a ring buffer of Config.Memory.MaxRecords entries; once it is full, appending a record
+// evicts the oldest one. It suits ephemeral topics and tests which should not touch the disk.
+type MemoryLog struct {
+	mu sync.RWMutex
+
+	Config  Config
+	records []*api.Record
+	start   int    // position of the oldest record in records
+	count   int    // number of records held
+	lowest  uint64 // offset of the oldest record
+}
+
+// NewMemoryLog creates an empty in-memory log.
+func NewMemoryLog(c Config) *MemoryLog {
+	if c.Memory.MaxRecords == 0 {
+		c.Memory.MaxRecords = 1024
+	}
+	return &MemoryLog{
+		Config:  c,
+		records: make([]*api.Record, c.Memory.MaxRecords),
+		lowest:  c.Segment.InitialOffset,
+	}
+}
+
+// Append appends a copy of the record to the log and returns its offset. As by Log, records are stamped with
+// the current time unless they carry a timestamp, and records larger than Config.Limits.MaxRecordBytes are
+// rejected.
+func (m *MemoryLog) Append(record *api.Record) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	offset := m.lowest + uint64(m.count)
+	record.Offset = offset
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
+	if size, max := uint64(proto.Size(record)), m.Config.Limits.MaxRecordBytes; max != 0 && size > max {
+		return 0, api.ErrorRecordTooLarge{Size: size, Max: max}
+	}
+	if m.count == len(m.records) {
+		m.evict()
+	}
+	m.records[(m.start+m.count)%len(m.records)] = proto.Clone(record).(*api.Record)
+	m.count++
+	return record.Offset, nil
+}
+
+// Read returns the record at the given offset.
+func (m *MemoryLog) Read(offset uint64) (*api.Record, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if offset < m.lowest || offset >= m.lowest+uint64(m.count) {
+		return nil, api.ErrorOffsetOutOfRange{Offset: offset}
+	}
+	record := m.records[(m.start+int(offset-m.lowest))%len(m.records)]
+	if expired(record, time.Now()) {
+		return nil, api.ErrorRecordExpired{Offset: offset}
+	}
+	return proto.Clone(record).(*api.Record), nil
+}
+
+// MaxRecordBytes returns the size limit of the log's marshaled records, zero if there is none.
+func (m *MemoryLog) MaxRecordBytes() uint64 {
+	return m.Config.Limits.MaxRecordBytes
+}
+
+// LowestOffset returns the offset of the oldest record held by the log.
+func (m *MemoryLog) LowestOffset() (uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lowest, nil
+}
+
+// HighestOffset returns the offset of the newest record held by the log.
+func (m *MemoryLog) HighestOffset() (uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	off := m.lowest + uint64(m.count)
+	if off == 0 {
+		return off, nil
+	}
+	return off - 1, nil
+}
+
+// Truncate removes all records whose offset is lower than or equal to lowest.
+func (m *MemoryLog) Truncate(lowest uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.count > 0 && m.lowest <= lowest {
+		m.evict()
+	}
+	return nil
+}
+
+// TruncateAfter removes all records whose offset is greater than the given offset, so that the next record
+// appended to the log gets offset+1. The removed records are passed to the OnEvict hook, if any.
+func (m *MemoryLog) TruncateAfter(offset uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if offset == math.MaxUint64 {
+		return nil
+	}
+	next := offset + 1
+	m.dropFrom(next)
+	if next < m.lowest {
+		// every record was removed and the log restarts at next
+		m.lowest = next
+	}
+	return nil
+}
+
+// dropFrom drops the records whose offset is greater than or equal to next and passes them to the OnEvict hook,
+// if any, in offset order.
+func (m *MemoryLog) dropFrom(next uint64) {
+	keep := 0
+	if next > m.lowest {
+		if next-m.lowest >= uint64(m.count) {
+			return
+		}
+		keep = int(next - m.lowest)
+	}
+	for i := keep; i < m.count; i++ {
+		pos := (m.start + i) % len(m.records)
+		record := m.records[pos]
+		m.records[pos] = nil
+		if m.Config.Memory.OnEvict != nil {
+			m.Config.Memory.OnEvict(record)
+		}
+	}
+	m.count = keep
+}
+
+// evict drops the oldest record and passes it to the OnEvict hook, if any.
+func (m *MemoryLog) evict() {
+	record := m.records[m.start]
+	m.records[m.start] = nil
+	m.start = (m.start + 1) % len(m.records)
+	m.count--
+	m.lowest++
+	if m.Config.Memory.OnEvict != nil {
+		m.Config.Memory.OnEvict(record)
+	}
+}
+
+// Close is a no-op; it makes MemoryLog interchangeable with Log.
+func (m *MemoryLog) Close() error {
+	return nil
+}
+
+// Remove drops all records held by the log.
+func (m *MemoryLog) Remove() error {
+	return m.Reset()
+}
+
+// Reset drops all records, passing them to the OnEvict hook if any, and restarts the log at
+// Config.Segment.InitialOffset.
+func (m *MemoryLog) Reset() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropFrom(m.lowest)
+	m.start = 0
+	m.lowest = m.Config.Segment.InitialOffset
+	return nil
+}
@@ -0,0 +1,126 @@
+package log
+
+import (
+	"errors"
+	"testing"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryLog(t *testing.T) {
+	var evicted []uint64
+	c := Config{}
+	c.Memory.MaxRecords = 3
+	c.Memory.OnEvict = func(record *api.Record) {
+		evicted = append(evicted, record.Offset)
+	}
+	m := NewMemoryLog(c)
+
+	_, err := m.Read(0)
+	require.Equal(t, api.ErrorOffsetOutOfRange{Offset: 0}, err)
+
+	for i := uint64(0); i < 5; i++ {
+		off, err := m.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+
+	// the oldest records are evicted once the log is full
+	require.Equal(t, []uint64{0, 1}, evicted)
+	_, err = m.Read(1)
+	require.Equal(t, api.ErrorOffsetOutOfRange{Offset: 1}, err)
+	for off := uint64(2); off < 5; off++ {
+		record, err := m.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+	lowest, err := m.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	highest, err := m.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+
+	require.NoError(t, m.Truncate(3))
+	_, err = m.Read(3)
+	require.Error(t, err)
+	_, err = m.Read(4)
+	require.NoError(t, err)
+
+	require.NoError(t, m.Reset())
+	_, err = m.Read(4)
+	require.Error(t, err)
+	off, err := m.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func TestMemoryLogTruncateAfter(t *testing.T) {
+	var evicted []uint64
+	c := Config{}
+	c.Memory.MaxRecords = 3
+	c.Memory.OnEvict = func(record *api.Record) {
+		evicted = append(evicted, record.Offset)
+	}
+	m := NewMemoryLog(c)
+	for i := 0; i < 5; i++ {
+		_, err := m.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, m.TruncateAfter(3))
+	require.Equal(t, []uint64{0, 1, 4}, evicted)
+	_, err := m.Read(4)
+	require.Equal(t, api.ErrorOffsetOutOfRange{Offset: 4}, err)
+	record, err := m.Read(3)
+	require.NoError(t, err)
+	require.NotZero(t, record.Timestamp)
+	off, err := m.Append(&api.Record{Value: []byte("hello world"), Timestamp: 42})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	record, err = m.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, int64(42), record.Timestamp)
+
+	// truncating below the oldest record empties the log, which continues after the offset
+	require.NoError(t, m.TruncateAfter(0))
+	require.Equal(t, []uint64{0, 1, 4, 2, 3, 4}, evicted)
+	_, err = m.Read(2)
+	require.Error(t, err)
+	off, err = m.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	// a reset evicts every record
+	_, err = m.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	evicted = nil
+	require.NoError(t, m.Reset())
+	require.Equal(t, []uint64{1, 2}, evicted)
+	_, err = m.Read(1)
+	require.Error(t, err)
+}
+
+func TestMemoryLogRecordSizeLimit(t *testing.T) {
+	var evicted []uint64
+	c := Config{}
+	c.Memory.MaxRecords = 1
+	c.Memory.OnEvict = func(record *api.Record) {
+		evicted = append(evicted, record.Offset)
+	}
+	c.Limits.MaxRecordBytes = 32
+	m := NewMemoryLog(c)
+	require.Equal(t, uint64(32), m.MaxRecordBytes())
+	_, err := m.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// a rejected record neither takes an offset nor evicts a record
+	_, err = m.Append(&api.Record{Value: make([]byte, 64)})
+	require.True(t, errors.As(err, &api.ErrorRecordTooLarge{}))
+	require.Empty(t, evicted)
+	off, err := m.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
@@ -0,0 +1,231 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+
+	api "github.com/kartpop/dclog/api/v1"
+)
+
+// mergeExt is the extension of the files a merged segment is written to before they replace the segment files.
+const mergeExt = ".merging"
+
+// mergeRun is a run of adjacent sealed segments to merge, along with the next offset and the store size of every
+// segment when the run was planned.
+type mergeRun struct {
+	segments []*segment
+	next     []uint64
+	size     []uint64
+}
+
+// MergeSegments merges runs of adjacent sealed segments into single segments, as long as a merged segment stays
+// within the Segment limits. Records keep their offsets; the merged segment takes the base offset of the first
+// segment of its run. It is called periodically when Config.Merge.Interval is set.
+//
+// The merged segments are written without holding the log's lock, so that the log is read and appended to
+// meanwhile. The lock is only taken to swap a merged segment in for its run.
+func (l *Log) MergeSegments() error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	l.merging.Lock()
+	defer l.merging.Unlock()
+	l.mu.RLock()
+	if err := l.checkOpen(); err != nil {
+		l.mu.RUnlock()
+		return err
+	}
+	runs := l.mergeRuns()
+	l.mu.RUnlock()
+	for _, run := range runs {
+		if err := l.merge(run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeRuns returns the runs of sealed segments which can be merged.
+func (l *Log) mergeRuns() []mergeRun {
+	var runs []mergeRun
+	sealed := l.segments[:len(l.segments)-1]
+	for i := 0; i < len(sealed); {
+		j, storeBytes, indexBytes := i+1, sealed[i].store.size, sealed[i].index.size
+		for ; j < len(sealed); j++ {
+			next := sealed[j]
+			storeBytes += next.store.size
+			indexBytes += next.index.size
+			if next.baseOffset != sealed[j-1].nextOffset ||
+				storeBytes > l.Config.Segment.MaxStoreBytes || indexBytes > l.Config.Segment.MaxIndexBytes {
+				break
+			}
+		}
+		if j-i >= 2 {
+			run := mergeRun{segments: sealed[i:j:j]}
+			for _, seg := range run.segments {
+				run.next = append(run.next, seg.nextOffset)
+				run.size = append(run.size, seg.store.size)
+			}
+			runs = append(runs, run)
+		}
+		i = j
+	}
+	return runs
+}
+
+// merge writes the records of a run of segments to a single segment which replaces them.
+//
+// The merged store is the concatenation of the segments' stores and the merged index holds an entry for every
+// record of the merged store. Both are written to temporary files, then renamed over the first segment's files,
+// before the other segments are removed. The run is skipped if it was truncated or removed while it was written.
+func (l *Log) merge(run mergeRun) error {
+	fs := l.Config.fs()
+	base := run.segments[0].baseOffset
+	storePath, indexPath := segmentPath(l.Dir, base, ".store"), segmentPath(l.Dir, base, ".index")
+	if err := l.writeMerged(run, storePath+mergeExt, indexPath+mergeExt); err != nil {
+		l.removeMergeFiles()
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+		if l.findRun(run) < 0 {
+			// the run's segments were closed by a truncation
+			return nil
+		}
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if atomic.LoadInt32(&l.open) == 0 {
+		l.removeMergeFiles()
+		return ErrNotOpen
+	}
+	i := l.findRun(run)
+	if i < 0 {
+		return l.removeMergeFiles()
+	}
+	// until the merged segment replaces the run, the run's segments keep reading the files they opened, and a
+	// crash leaves an interrupted merge which the log recovers from when it is opened
+	if err := fs.Rename(storePath+mergeExt, storePath); err != nil {
+		l.removeMergeFiles()
+		return err
+	}
+	if err := fs.Rename(indexPath+mergeExt, indexPath); err != nil {
+		return err
+	}
+	merged, err := newSegment(l.Dir, base, l.Config)
+	if err != nil {
+		return err
+	}
+	if err = merged.load(func(*api.Record) {}); err != nil {
+		merged.Close()
+		return err
+	}
+	merged.sealKeys()
+	segments := append([]*segment{}, l.segments[:i]...)
+	segments = append(segments, merged)
+	l.segments = append(segments, l.segments[i+len(run.segments):]...)
+
+	// the first segment's files were replaced by the merged segment's, the others are removed; their records
+	// live on in the merged segment, so the hooks are not told of a deletion
+	err = run.segments[0].Close()
+	for _, seg := range run.segments[1:] {
+		if rerr := seg.Remove(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// findRun returns the position of a run in the log's segments, or -1 if its segments were since removed or
+// truncated.
+func (l *Log) findRun(run mergeRun) int {
+	for i, seg := range l.segments {
+		if seg != run.segments[0] {
+			continue
+		}
+		if i+len(run.segments) > len(l.segments)-1 {
+			return -1
+		}
+		for j, seg := range run.segments {
+			if l.segments[i+j] != seg || seg.nextOffset != run.next[j] || seg.store.size != run.size[j] {
+				return -1
+			}
+		}
+		return i
+	}
+	return -1
+}
+
+// writeMerged writes the store and the index of the segment merging a run to the given files.
+//
+// Sealed segments are not appended to, so their stores are read without the log's lock, up to the size they
+// had when the run was planned. The index entries are rebuilt from the merged store rather than read from the
+// segments' indexes, which a concurrent truncation may unmap.
+func (l *Log) writeMerged(run mergeRun, storeName, indexName string) error {
+	fs := l.Config.fs()
+	storeFile, err := fs.OpenFile(storeName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer storeFile.Close()
+	base := run.segments[0].baseOffset
+	var entries []byte
+	var shift uint64
+	for i, seg := range run.segments {
+		size := run.size[i]
+		if _, err = io.Copy(storeFile, io.NewSectionReader(seg.store, 0, int64(size))); err != nil {
+			return err
+		}
+		off := seg.baseOffset
+		for pos := uint64(0); pos < size; off++ {
+			length := make([]byte, lenWidth)
+			if _, err = storeFile.ReadAt(length, int64(shift+pos)); err != nil {
+				return err
+			}
+			entry := make([]byte, entWidth)
+			enc.PutUint32(entry[:offWidth], uint32(off-base))
+			enc.PutUint64(entry[offWidth:], shift+pos)
+			entries = append(entries, entry...)
+			pos += lenWidth + enc.Uint64(length)
+			if pos > size {
+				return fmt.Errorf("%w: record at offset %d is beyond the end of the store of segment %d", ErrCorrupt, off, seg.baseOffset)
+			}
+		}
+		if off != run.next[i] {
+			return fmt.Errorf("%w: store of segment %d ends at offset %d, its index at offset %d", ErrCorrupt, seg.baseOffset, off, run.next[i])
+		}
+		shift += size
+	}
+	if err = storeFile.Sync(); err != nil {
+		return err
+	}
+	indexFile, err := fs.OpenFile(indexName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+	if _, err = indexFile.Write(entries); err != nil {
+		return err
+	}
+	return indexFile.Sync()
+}
+
+// removeMergeFiles removes the temporary files of a merge which was interrupted.
+func (l *Log) removeMergeFiles() error {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if path.Ext(file.Name()) == mergeExt {
+			if err = l.Config.fs().Remove(path.Join(l.Dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	api "github.com/kartpop/dclog/api/v1"
+)
+
+const (
+	// producerWindow is the number of most recent runs of sequences remembered per producer.
+	// Retries of any sequence of these runs are answered with the offset of the original record.
+	producerWindow = 5
+	// producerSnapshotFile is the file of the log directory which keeps the state of the producers as of the
+	// records removed from the front of the log, so that it survives their removal.
+	producerSnapshotFile = "producers.snapshot"
+	// snapshotWidth is the width of a run of sequences in the producer snapshot: the producer ID, the first and
+	// the last sequence, the offset of the first sequence and the timestamp of the producer's latest record.
+	snapshotWidth = 5 * lenWidth
+	// defaultProducerExpiration is how long the state of an idle producer is kept unless configured otherwise.
+	defaultProducerExpiration = 24 * time.Hour
+)
+
+// sequenced is a run of consecutive sequences which a producer appended at consecutive offsets, such as a batch.
+type sequenced struct {
+	first, last uint64 // sequences of the run
+	offset      uint64 // offset of the first sequence
+}
+
+// producerState holds the most recent runs of sequences appended by a producer, oldest first, and the timestamp
+// of its latest record.
+type producerState struct {
+	recent []sequenced
+	latest int64
+}
+
+// observe records the timestamp of a record appended by the producer.
+func (p *producerState) observe(timestamp int64) {
+	if timestamp > p.latest {
+		p.latest = timestamp
+	}
+}
+
+// last returns the last sequence appended by the producer.
+func (p *producerState) last() uint64 {
+	return p.recent[len(p.recent)-1].last
+}
+
+// lookup returns the offset of the record appended with the given sequence.
+// If the sequence is new, it returns whether the sequence is the next one expected from the producer.
+func (p *producerState) lookup(sequence uint64) (offset uint64, duplicate bool, err error) {
+	last := p.last()
+	if sequence == last+1 {
+		return 0, false, nil
+	}
+	for _, r := range p.recent {
+		if r.first <= sequence && sequence <= r.last {
+			return r.offset + sequence - r.first, true, nil
+		}
+	}
+	return 0, false, api.ErrorOutOfOrderSequence{Sequence: sequence, Expected: last + 1}
+}
+
+// add records that the given sequence was appended at offset. The sequence extends the latest run if it follows
+// it at the next offset.
+func (p *producerState) add(sequence, offset uint64) {
+	if n := len(p.recent); n > 0 {
+		r := &p.recent[n-1]
+		if sequence == r.last+1 && offset == r.offset+sequence-r.first {
+			r.last = sequence
+			return
+		}
+	}
+	p.recent = append(p.recent, sequenced{sequence, sequence, offset})
+	if len(p.recent) > producerWindow {
+		p.recent = p.recent[1:]
+	}
+}
+
+// checkProducer returns the offset of the original record if the record is a retry of a sequence already
+// appended by its producer. A producer's first record may use any sequence number.
+func (l *Log) checkProducer(record *api.Record) (offset uint64, duplicate bool, err error) {
+	if record.ProducerId == 0 {
+		return 0, false, nil
+	}
+	p, ok := l.producers[record.ProducerId]
+	if !ok {
+		return 0, false, nil
+	}
+	offset, duplicate, err = p.lookup(record.Sequence)
+	if e, ok := err.(api.ErrorOutOfOrderSequence); ok {
+		e.ProducerID = record.ProducerId
+		return 0, false, e
+	}
+	return offset, duplicate, err
+}
+
+// trackProducer updates the producer state with a record which was appended to the log.
+func (l *Log) trackProducer(record *api.Record) {
+	if record.ProducerId == 0 {
+		return
+	}
+	p, ok := l.producers[record.ProducerId]
+	if !ok {
+		p = &producerState{}
+		l.producers[record.ProducerId] = p
+	}
+	p.add(record.Sequence, record.Offset)
+	p.observe(record.Timestamp)
+}
+
+// expireProducers drops the producers whose latest record is older than Config.Producers.Expiration.
+func (l *Log) expireProducers(producers map[uint64]*producerState, now time.Time) {
+	oldest := now.Add(-l.Config.Producers.Expiration).UnixNano()
+	for id, p := range producers {
+		if p.latest < oldest {
+			delete(producers, id)
+		}
+	}
+}
+
+// readProducerSnapshot reads the producer snapshot, which holds the state of the producers as of the records below
+// the offset next. A log without a snapshot has an empty one.
+func (l *Log) readProducerSnapshot() (producers map[uint64]*producerState, next uint64, err error) {
+	producers = make(map[uint64]*producerState)
+	fs := l.Config.fs()
+	name := path.Join(l.Dir, producerSnapshotFile)
+	fi, err := fs.Stat(name)
+	if os.IsNotExist(err) {
+		return producers, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if fi.Size() < lenWidth || (fi.Size()-lenWidth)%snapshotWidth != 0 {
+		return nil, 0, fmt.Errorf("%w: producer snapshot holds %d bytes", ErrCorrupt, fi.Size())
+	}
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	b := make([]byte, fi.Size())
+	if _, err = f.ReadAt(b, 0); err != nil {
+		return nil, 0, err
+	}
+	next = enc.Uint64(b)
+	for b = b[lenWidth:]; len(b) > 0; b = b[snapshotWidth:] {
+		id := enc.Uint64(b)
+		p, ok := producers[id]
+		if !ok {
+			p = &producerState{}
+			producers[id] = p
+		}
+		p.recent = append(p.recent, sequenced{
+			first:  enc.Uint64(b[lenWidth:]),
+			last:   enc.Uint64(b[2*lenWidth:]),
+			offset: enc.Uint64(b[3*lenWidth:]),
+		})
+		p.observe(int64(enc.Uint64(b[4*lenWidth:])))
+	}
+	return producers, next, nil
+}
+
+// snapshotProducers adds the records of segments about to be removed from the front of the log, or up to a
+// quarantined segment, to the producer snapshot. Records which cannot be read are left out, and expired producers
+// are dropped from the snapshot and from the log's state. The snapshot is written to a temporary file which then
+// replaces it, so that a crash leaves either snapshot whole.
+func (l *Log) snapshotProducers(removed []*segment) error {
+	if len(removed) == 0 {
+		return nil
+	}
+	producers, next, err := l.readProducerSnapshot()
+	if err != nil {
+		return err
+	}
+	for _, seg := range removed {
+		for off := seg.baseOffset; off < seg.nextOffset; off++ {
+			record, err := seg.Read(off)
+			if err != nil {
+				// a damaged record, as found in a quarantined segment, is left out
+				continue
+			}
+			if record.Offset < next || record.ProducerId == 0 {
+				continue
+			}
+			p, ok := producers[record.ProducerId]
+			if !ok {
+				p = &producerState{}
+				producers[record.ProducerId] = p
+			}
+			p.add(record.Sequence, record.Offset)
+			p.observe(record.Timestamp)
+		}
+	}
+	now := time.Now()
+	l.expireProducers(producers, now)
+	l.expireProducers(l.producers, now)
+	if last := removed[len(removed)-1].nextOffset; last > next {
+		next = last
+	}
+
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, next)
+	for id, p := range producers {
+		for _, r := range p.recent {
+			run := make([]byte, snapshotWidth)
+			enc.PutUint64(run, id)
+			enc.PutUint64(run[lenWidth:], r.first)
+			enc.PutUint64(run[2*lenWidth:], r.last)
+			enc.PutUint64(run[3*lenWidth:], r.offset)
+			enc.PutUint64(run[4*lenWidth:], uint64(p.latest))
+			b = append(b, run...)
+		}
+	}
+	fs := l.Config.fs()
+	name := path.Join(l.Dir, producerSnapshotFile)
+	f, err := fs.OpenFile(name+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(name+".tmp", name)
+}
@@ -0,0 +1,52 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+var (
+	// ErrNotOpen is returned by Ready while the log recovers its segments, when it is set up or reset, and once it
+	// is closed. It is returned by the log's methods after a Reset failed.
+	ErrNotOpen = errors.New("log is not open")
+	// ErrDiskFull is returned by Ready when the log's filesystem has less free space than Limits.MinFreeBytes, or
+	// none at all.
+	ErrDiskFull = errors.New("disk is full")
+)
+
+// Ready returns nil if the log has recovered its segments and can accept appends, and otherwise the reason why
+// not. It does not wait for operations in progress on the log.
+func (l *Log) Ready() error {
+	if atomic.LoadInt32(&l.open) == 0 {
+		return ErrNotOpen
+	}
+	if l.Config.ReadOnly {
+		return nil
+	}
+	free, err := freeBytes(l.Dir)
+	if err != nil {
+		return err
+	}
+	if min := l.Config.Limits.MinFreeBytes; free == 0 || free < min {
+		return fmt.Errorf("%w: %d bytes free, below the floor of %d bytes", ErrDiskFull, free, min)
+	}
+	return nil
+}
+
+// setOpen records whether the log is open, for Ready.
+func (l *Log) setOpen(open bool) {
+	var v int32
+	if open {
+		v = 1
+	}
+	atomic.StoreInt32(&l.open, v)
+}
+
+// checkOpen returns ErrNotOpen if the log has no segments, as left by a failed Reset.
+func (l *Log) checkOpen() error {
+	if l.activeSegment == nil {
+		return ErrNotOpen
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package log
+
+import (
+	"fmt"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// recovery describes how the files of a segment are made consistent when the segment is opened, or repaired
+// offline: the index keeps its leading entries which frame complete records of the store, entries are rebuilt for
+// the complete records which follow them in the store, and the store is truncated after the last of these records.
+type recovery struct {
+	storeBytes, indexEntries uint64   // sizes of the store and the index before the recovery
+	valid                    uint64   // leading index entries which are kept
+	rebuilt                  []uint64 // positions of the records following them, whose entries are rebuilt
+	end                      uint64   // position following the last record kept
+}
+
+// needed returns whether the recovery changes the segment's files.
+func (r recovery) needed() bool {
+	return r.valid != r.indexEntries || len(r.rebuilt) > 0 || r.end != r.storeBytes
+}
+
+// next returns the segment's next offset after the recovery.
+func (r recovery) next(baseOffset uint64) uint64 {
+	return baseOffset + r.valid + uint64(len(r.rebuilt))
+}
+
+// inspect works out the recovery of the segment without changing its files.
+//
+// Index entries are kept while each points right after the previous record and frames a complete record. Such
+// entries may be lost or torn by a crash, since the index is written after the store, or missing when the index
+// file was lost. Records are only re-indexed if they are intact and hold the expected offset; records whose bytes
+// are damaged within an intact framing are left to the scrubber. It fails if the intact records do not fit in the
+// index, as when Segment.MaxIndexBytes was lowered, rather than have the store truncated after the last that fits.
+func (s *segment) inspect() (recovery, error) {
+	r := recovery{storeBytes: s.store.size, indexEntries: s.index.size / entWidth}
+	for ; r.valid < r.indexEntries; r.valid++ {
+		rel, pos, err := s.index.Read(int64(r.valid))
+		if err != nil || uint64(rel) != r.valid || pos != r.end {
+			break
+		}
+		n, ok, err := s.recordLength(pos)
+		if err != nil {
+			return r, err
+		}
+		if !ok {
+			break
+		}
+		r.end = pos + lenWidth + n
+	}
+	capacity := s.config.Segment.MaxIndexBytes / entWidth
+	for pos := r.end; ; {
+		n, ok, err := s.recordLength(pos)
+		if err != nil {
+			return r, err
+		}
+		if !ok {
+			break
+		}
+		b := make([]byte, n)
+		if _, err = s.store.ReadAt(b, int64(pos+lenWidth)); err != nil {
+			return r, err
+		}
+		record := &api.Record{}
+		if proto.Unmarshal(b, record) != nil || record.Offset != r.next(s.baseOffset) {
+			break
+		}
+		if ok, _ := verifyChecksum(record); !ok {
+			break
+		}
+		if r.valid+uint64(len(r.rebuilt)) == capacity {
+			// truncating the store here would discard intact records
+			return r, fmt.Errorf("segment %d holds more records than an index of %d bytes can hold",
+				s.baseOffset, s.config.Segment.MaxIndexBytes)
+		}
+		r.rebuilt = append(r.rebuilt, pos)
+		pos += lenWidth + n
+		r.end = pos
+	}
+	return r, nil
+}
+
+// recordLength returns the length of the record stored at the given position, and whether the store holds the
+// complete record.
+func (s *segment) recordLength(pos uint64) (uint64, bool, error) {
+	if pos+lenWidth > s.store.size {
+		return 0, false, nil
+	}
+	size := make([]byte, lenWidth)
+	if _, err := s.store.ReadAt(size, int64(pos)); err != nil {
+		return 0, false, err
+	}
+	n := enc.Uint64(size)
+	return n, n <= s.store.size-pos-lenWidth, nil
+}
+
+// recover makes the segment's files consistent as worked out by inspect. A read-only segment ignores the index
+// entries which are not kept, such as entries of a live log whose records are still buffered by the process owning
+// it, and indexes no record.
+func (s *segment) recover() error {
+	r, err := s.inspect()
+	if err != nil {
+		return err
+	}
+	if s.config.ReadOnly {
+		s.index.size = r.valid * entWidth
+		return nil
+	}
+	if !r.needed() {
+		return nil
+	}
+	s.index.Truncate(uint32(r.valid))
+	for i, pos := range r.rebuilt {
+		if err = s.index.Write(uint32(r.valid)+uint32(i), pos); err != nil {
+			return err
+		}
+	}
+	if err = s.store.Truncate(r.end); err != nil {
+		return err
+	}
+	// the recovery is persisted before new records are appended, so that a later crash cannot bring back
+	// discarded records behind them
+	return s.Sync()
+}
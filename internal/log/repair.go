@@ -0,0 +1,287 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrPlanChanged is returned by Repair when the log directory no longer matches the plan it was given.
+var ErrPlanChanged = errors.New("log directory changed since the repair was planned")
+
+// RepairKind is the kind of a change planned by PlanRepair.
+type RepairKind int
+
+const (
+	RepairRecover    RepairKind = iota // truncate the torn records of a segment and rebuild its index
+	RepairQuarantine                   // move files to the quarantine directory
+	RepairRemove                       // remove files which hold no record found elsewhere
+)
+
+func (k RepairKind) String() string {
+	switch k {
+	case RepairQuarantine:
+		return "quarantine"
+	case RepairRemove:
+		return "remove"
+	}
+	return "recover"
+}
+
+// RepairAction is a change to a log directory planned by PlanRepair and applied by Repair.
+type RepairAction struct {
+	Kind       RepairKind
+	BaseOffset uint64
+	Files      []string
+	Reason     string
+}
+
+func (a RepairAction) String() string {
+	return fmt.Sprintf("%s %s: %s", a.Kind, strings.Join(a.Files, ", "), a.Reason)
+}
+
+// plannedSegment is a segment which remains in the log once the planned changes are applied.
+type plannedSegment struct {
+	base, next uint64
+	files      []string
+}
+
+// PlanRepair scans a log directory, without changing it, and returns the changes which make it consistent: torn
+// records are truncated and indexes rebuilt from their stores, as a log does when it opens its segments; segments
+// overlapping the previous one and empty segments left by a lost roll are removed or quarantined, as when the log
+// is set up; indexes without a store are quarantined and the files of an interrupted merge removed. An empty
+// segment marked as following a gap, as left by a quarantine or by records appended at preserved offsets, is kept.
+//
+// The configuration must match the log's, since indexes are sized from the Segment limits.
+func PlanRepair(dir string, c Config) ([]RepairAction, error) {
+	c = c.withDefaults()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var plan []RepairAction
+	stores, indexes, gaps := map[uint64]bool{}, map[uint64]bool{}, map[uint64]bool{}
+	for _, file := range files {
+		ext := path.Ext(file.Name())
+		if ext == mergeExt {
+			plan = append(plan, RepairAction{
+				Kind:   RepairRemove,
+				Files:  []string{path.Join(dir, file.Name())},
+				Reason: "temporary file of an interrupted merge",
+			})
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch ext {
+		case ".store":
+			stores[base] = true
+		case ".index":
+			indexes[base] = true
+		case gapExt:
+			gaps[base] = true
+		}
+	}
+	var bases []uint64
+	for base := range stores {
+		bases = append(bases, base)
+	}
+	for base := range indexes {
+		if !stores[base] {
+			bases = append(bases, base)
+		}
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	var kept []plannedSegment
+	for _, base := range bases {
+		storePath, indexPath := segmentPath(dir, base, ".store"), segmentPath(dir, base, ".index")
+		if !stores[base] {
+			plan = append(plan, RepairAction{
+				Kind:       RepairQuarantine,
+				BaseOffset: base,
+				Files:      []string{indexPath},
+				Reason:     "the segment's store is missing",
+			})
+			continue
+		}
+		r, err := inspectSegment(dir, base, c, indexes[base])
+		if err != nil {
+			return nil, err
+		}
+		seg := plannedSegment{base: base, next: r.next(base), files: []string{storePath, indexPath}}
+		if n := len(kept); n > 0 {
+			prev := kept[n-1]
+			if overlaps, covered := overlapping(prev.next, seg.base, seg.next); overlaps {
+				action := RepairAction{Kind: RepairQuarantine, BaseOffset: base, Files: []string{storePath}}
+				if indexes[base] {
+					action.Files = append(action.Files, indexPath)
+				}
+				action.Reason = fmt.Sprintf("offsets %d to %d overlap segment %d", seg.base, seg.next, prev.base)
+				if covered {
+					action.Kind = RepairRemove
+					action.Reason = fmt.Sprintf("records are duplicated by segment %d", prev.base)
+				}
+				plan = append(plan, action)
+				continue
+			}
+		}
+		if !indexes[base] {
+			plan = append(plan, RepairAction{
+				Kind:       RepairRecover,
+				BaseOffset: base,
+				Files:      seg.files,
+				Reason:     "the index is missing; " + describeRecovery(r),
+			})
+		} else if r.needed() {
+			plan = append(plan, RepairAction{
+				Kind:       RepairRecover,
+				BaseOffset: base,
+				Files:      seg.files,
+				Reason:     describeRecovery(r),
+			})
+		}
+		kept = append(kept, seg)
+	}
+	for n := len(kept); n > 1; n-- {
+		last := kept[n-1]
+		if !lostRoll(kept[n-2].next, last.base, last.next) || gaps[last.base] {
+			// a segment marked as following a gap does not follow the previous one on purpose
+			break
+		}
+		plan = append(plan, RepairAction{
+			Kind:       RepairRemove,
+			BaseOffset: last.base,
+			Files:      last.files,
+			Reason:     fmt.Sprintf("empty segment does not follow segment %d, whose last records were lost", kept[n-2].base),
+		})
+	}
+	return plan, nil
+}
+
+// Repair applies to a log directory the changes planned by PlanRepair. It fails with ErrLocked if a log is open
+// on the directory. Once it holds the directory's lock, it plans the repair again and fails with ErrPlanChanged,
+// without changing anything, unless the plan is the one it was given.
+func Repair(dir string, c Config, plan []RepairAction) error {
+	c = c.withDefaults()
+	lock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unlockDir(lock)
+	current, err := PlanRepair(dir, c)
+	if err != nil {
+		return err
+	}
+	if !samePlan(current, plan) {
+		return ErrPlanChanged
+	}
+	for _, action := range plan {
+		switch action.Kind {
+		case RepairRecover:
+			// opening the segment recovers it
+			seg, err := newSegment(dir, action.BaseOffset, c)
+			if err != nil {
+				return err
+			}
+			if err = seg.Close(); err != nil {
+				return err
+			}
+		case RepairQuarantine:
+			for _, name := range action.Files {
+				if err = quarantineFile(c.fs(), dir, name); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		case RepairRemove:
+			for _, name := range action.Files {
+				if err = c.fs().Remove(name); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// samePlan returns whether two repair plans hold the same actions.
+func samePlan(a, b []RepairAction) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() || a[i].BaseOffset != b[i].BaseOffset {
+			return false
+		}
+	}
+	return true
+}
+
+// inspectSegment opens a segment's files read-only and works out its recovery.
+func inspectSegment(dir string, base uint64, c Config, hasIndex bool) (recovery, error) {
+	fs := c.fs()
+	readOnly := c
+	readOnly.ReadOnly = true
+	f, err := fs.OpenFile(segmentPath(dir, base, ".store"), os.O_RDONLY, 0644)
+	if err != nil {
+		return recovery{}, err
+	}
+	s := &segment{baseOffset: base, config: c, index: &index{readOnly: true}}
+	if s.store, err = newStore(f, readOnly); err != nil {
+		f.Close()
+		return recovery{}, err
+	}
+	defer s.store.Close()
+	if hasIndex {
+		if f, err = fs.OpenFile(segmentPath(dir, base, ".index"), os.O_RDONLY, 0644); err != nil {
+			return recovery{}, err
+		}
+		if s.index, err = newIndex(f, readOnly); err != nil {
+			f.Close()
+			return recovery{}, err
+		}
+		defer s.index.Close()
+		if s.index.size > c.Segment.MaxIndexBytes {
+			return recovery{}, fmt.Errorf("index of segment %d holds %d bytes, more than the limit of %d bytes; "+
+				"the configuration must match the log's", base, s.index.size, c.Segment.MaxIndexBytes)
+		}
+	}
+	return s.inspect()
+}
+
+// describeRecovery explains the changes a recovery makes to a segment.
+func describeRecovery(r recovery) string {
+	var changes []string
+	if dropped := r.indexEntries - r.valid; dropped > 0 {
+		changes = append(changes, fmt.Sprintf("drop %d index entries which do not point at complete records", dropped))
+	}
+	if len(r.rebuilt) > 0 {
+		changes = append(changes, fmt.Sprintf("index %d records found in the store", len(r.rebuilt)))
+	}
+	if r.end < r.storeBytes {
+		changes = append(changes, fmt.Sprintf("truncate %d bytes of torn or unindexed records from the store", r.storeBytes-r.end))
+	}
+	if changes == nil {
+		return "nothing to change"
+	}
+	return strings.Join(changes, ", ")
+}
+
+// overlapping returns whether a segment overlaps the offsets of the preceding segment, and whether all of its
+// records are duplicated by it.
+func overlapping(prevNext, base, next uint64) (overlaps, covered bool) {
+	return base < prevNext, next <= prevNext
+}
+
+// lostRoll returns whether a segment is empty and does not follow the preceding segment, as left by a crash which
+// lost the last records of the preceding segment after the segment was created.
+func lostRoll(prevNext, base, next uint64) bool {
+	return next == base && base != prevNext
+}
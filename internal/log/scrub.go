@@ -0,0 +1,300 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"sync/atomic"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrCorrupt is matched by the errors returned when reading damaged log data.
+var ErrCorrupt = errors.New("log data is corrupt")
+
+// quarantineDir is the subdirectory of the log directory which corrupt segments are moved to.
+const quarantineDir = "quarantine"
+
+// scrubChunk is the number of records the scrubber verifies at a time, while it holds the log's read lock.
+const scrubChunk = 256
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the CRC-32C of the record marshaled without its checksum.
+func checksum(record *api.Record) (uint32, error) {
+	sum := record.Checksum
+	record.Checksum = 0
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(record)
+	record.Checksum = sum
+	if err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(b, crcTable), nil
+}
+
+// verifyChecksum returns whether the record matches its checksum.
+// Records written before checksums were introduced have none and always match.
+func verifyChecksum(record *api.Record) (bool, error) {
+	if record.Checksum == 0 {
+		return true, nil
+	}
+	sum, err := checksum(record)
+	return sum == record.Checksum, err
+}
+
+// CorruptionError describes a segment whose store or index is damaged.
+type CorruptionError struct {
+	BaseOffset  uint64 // base offset of the corrupt segment
+	Offset      uint64 // offset of the first damaged record
+	Reason      string
+	Quarantined bool // whether the segment was moved to the quarantine directory
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("segment %d is corrupt at offset %d: %s", e.BaseOffset, e.Offset, e.Reason)
+}
+
+// Is makes errors.Is(err, ErrCorrupt) hold for corruption errors.
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// ScrubMetrics counts the work done and the corruptions found by the scrubber.
+type ScrubMetrics struct {
+	SegmentsScrubbed    uint64
+	RecordsScrubbed     uint64
+	CorruptSegments     uint64
+	QuarantinedSegments uint64
+}
+
+// verify checks the index entries of up to max records of the segment, from offset off whose record must start at
+// position next, against the framing of the store and every record against its checksum. It returns the offset
+// and the position following the last record verified; after the segment's last record, it also checks that
+// nothing follows it in the store. It returns a *CorruptionError describing the first damage found.
+func (s *segment) verify(off, next, max uint64) (uint64, uint64, error) {
+	corrupt := func(offset uint64, format string, a ...interface{}) (uint64, uint64, error) {
+		return 0, 0, &CorruptionError{BaseOffset: s.baseOffset, Offset: offset, Reason: fmt.Sprintf(format, a...)}
+	}
+	for end := off + max; off < s.nextOffset && off < end; off++ {
+		rel, pos, err := s.index.Read(int64(off - s.baseOffset))
+		if err != nil {
+			return corrupt(off, "reading index entry: %v", err)
+		}
+		if uint64(rel) != off-s.baseOffset {
+			return corrupt(off, "index entry holds relative offset %d", rel)
+		}
+		if pos != next {
+			return corrupt(off, "index entry points at position %d, expected %d", pos, next)
+		}
+		if pos+lenWidth > s.store.size {
+			return corrupt(off, "record length at position %d is beyond the end of the store", pos)
+		}
+		size := make([]byte, lenWidth)
+		if _, err = s.store.ReadAt(size, int64(pos)); err != nil {
+			return corrupt(off, "reading record length: %v", err)
+		}
+		n := enc.Uint64(size)
+		if n > s.store.size-pos-lenWidth {
+			return corrupt(off, "record length %d is beyond the end of the store", n)
+		}
+		if max := s.config.Limits.MaxRecordBytes; max != 0 && n > max {
+			return corrupt(off, "record length %d exceeds the limit of %d bytes", n, max)
+		}
+		b := make([]byte, n)
+		if _, err = s.store.ReadAt(b, int64(pos+lenWidth)); err != nil {
+			return corrupt(off, "reading record: %v", err)
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(b, record); err != nil {
+			return corrupt(off, "unmarshaling record: %v", err)
+		}
+		if record.Offset != off {
+			return corrupt(off, "record holds offset %d", record.Offset)
+		}
+		if ok, err := verifyChecksum(record); err != nil || !ok {
+			return corrupt(off, "record does not match its checksum")
+		}
+		next = pos + lenWidth + n
+	}
+	if off == s.nextOffset && next != s.store.size {
+		return corrupt(s.nextOffset, "%d bytes in the store are not indexed", s.store.size-next)
+	}
+	return off, next, nil
+}
+
+// Scrub verifies every sealed segment once and returns the corruptions found.
+func (l *Log) Scrub() ([]*CorruptionError, error) {
+	l.mu.RLock()
+	if err := l.checkOpen(); err != nil {
+		l.mu.RUnlock()
+		return nil, err
+	}
+	sealed := append([]*segment(nil), l.segments[:len(l.segments)-1]...)
+	l.mu.RUnlock()
+	var corruptions []*CorruptionError
+	for _, seg := range sealed {
+		corruption, err := l.scrubSegment(seg)
+		if err != nil {
+			return corruptions, err
+		}
+		if corruption != nil {
+			corruptions = append(corruptions, corruption)
+		}
+	}
+	return corruptions, nil
+}
+
+// ScrubMetrics returns the scrubber's counters.
+func (l *Log) ScrubMetrics() ScrubMetrics {
+	return ScrubMetrics{
+		SegmentsScrubbed:    atomic.LoadUint64(&l.scrubMetrics.SegmentsScrubbed),
+		RecordsScrubbed:     atomic.LoadUint64(&l.scrubMetrics.RecordsScrubbed),
+		CorruptSegments:     atomic.LoadUint64(&l.scrubMetrics.CorruptSegments),
+		QuarantinedSegments: atomic.LoadUint64(&l.scrubMetrics.QuarantinedSegments),
+	}
+}
+
+// scrubNext verifies the sealed segment following the one verified last, so that the background scrubber walks
+// the log one segment per tick.
+func (l *Log) scrubNext() error {
+	l.mu.RLock()
+	var next *segment
+	for _, seg := range l.segments[:len(l.segments)-1] {
+		if seg.baseOffset >= l.scrubCursor {
+			next = seg
+			break
+		}
+	}
+	if next == nil && len(l.segments) > 1 {
+		next = l.segments[0]
+	}
+	l.mu.RUnlock()
+	if next == nil {
+		return nil
+	}
+	l.scrubCursor = next.nextOffset
+	_, err := l.scrubSegment(next)
+	return err
+}
+
+// scrubSegment verifies a segment, then reports and optionally quarantines it if it is corrupt.
+// The segment is verified in chunks of records, so that appends are not held up for the whole segment. A segment
+// removed or truncated meanwhile is left alone.
+func (l *Log) scrubSegment(seg *segment) (*CorruptionError, error) {
+	l.mu.RLock()
+	next := seg.nextOffset
+	l.mu.RUnlock()
+	off, pos := seg.baseOffset, uint64(0)
+	var err error
+	for {
+		l.mu.RLock()
+		if !l.holds(seg) || seg == l.activeSegment || seg.nextOffset != next {
+			l.mu.RUnlock()
+			return nil, nil
+		}
+		off, pos, err = seg.verify(off, pos, scrubChunk)
+		l.mu.RUnlock()
+		if err != nil || off == next {
+			break
+		}
+	}
+	corruption, ok := err.(*CorruptionError)
+	if err != nil && !ok {
+		return nil, err
+	}
+	atomic.AddUint64(&l.scrubMetrics.SegmentsScrubbed, 1)
+	if !ok {
+		atomic.AddUint64(&l.scrubMetrics.RecordsScrubbed, next-seg.baseOffset)
+		return nil, nil
+	}
+	// the records before the damaged one were verified
+	atomic.AddUint64(&l.scrubMetrics.RecordsScrubbed, corruption.Offset-seg.baseOffset)
+	atomic.AddUint64(&l.scrubMetrics.CorruptSegments, 1)
+	if l.Config.Scrub.Quarantine && !l.Config.ReadOnly {
+		if err = l.quarantine(seg); err != nil {
+			return corruption, err
+		}
+		corruption.Quarantined = true
+		atomic.AddUint64(&l.scrubMetrics.QuarantinedSegments, 1)
+	}
+	if l.Config.Scrub.OnCorrupt != nil {
+		l.Config.Scrub.OnCorrupt(corruption)
+	}
+	return corruption, nil
+}
+
+// quarantine removes a sealed segment from the log and moves its files to the quarantine directory. The segment
+// following it is marked as following a gap, so that the quarantined offsets are not handed out again.
+//
+// As when segments are removed from the front of the log, the producers' state is snapshotted first, here up to
+// the end of the quarantined segment, whose readable records are kept in the snapshot.
+func (l *Log) quarantine(seg *segment) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.holds(seg) || seg == l.activeSegment {
+		return nil
+	}
+	for i, s := range l.segments[:len(l.segments)-1] {
+		if s != seg {
+			continue
+		}
+		if err := l.snapshotProducers(l.segments[:i+1]); err != nil {
+			return err
+		}
+		if err := markGap(l.Config.fs(), l.Dir, l.segments[i+1].baseOffset); err != nil {
+			return err
+		}
+	}
+	if err := seg.Close(); err != nil {
+		return err
+	}
+	for _, name := range []string{seg.store.Name(), seg.index.Name()} {
+		if err := quarantineFile(l.Config.fs(), l.Dir, name); err != nil {
+			return err
+		}
+	}
+	var segments []*segment
+	for _, s := range l.segments {
+		if s != seg {
+			segments = append(segments, s)
+		}
+	}
+	l.segments = segments
+	l.pruneTxns()
+	l.emit(event{kind: eventSegmentDeleted, base: seg.baseOffset, next: seg.nextOffset})
+	return nil
+}
+
+// quarantineFile moves a file of the log directory to the quarantine directory. A file quarantined earlier under
+// the same name is kept, and the file is given the first free name with a numbered suffix instead.
+func quarantineFile(fs FS, dir, name string) error {
+	dir = path.Join(dir, quarantineDir)
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	target := path.Join(dir, path.Base(name))
+	for i := 1; ; i++ {
+		_, err := fs.Stat(target)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target = path.Join(dir, fmt.Sprintf("%s.%d", path.Base(name), i))
+	}
+	return fs.Rename(name, target)
+}
+
+// holds returns whether the segment is still part of the log.
+func (l *Log) holds(seg *segment) bool {
+	for _, s := range l.segments {
+		if s == seg {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	api "github.com/kartpop/dclog/api/v1"
 	"google.golang.org/protobuf/proto"
@@ -15,27 +17,42 @@ type segment struct {
 	index                  *index
 	baseOffset, nextOffset uint64
 	config                 Config
+	expiresAt              int64 // latest expiry of the segment's records
+	persistent             bool  // whether the segment holds a record which never expires
+	keys                   map[string]uint64
+	bloom                  *bloomFilter
+	oldest, newest         int64      // timestamps of the segment's records
+	tail                   *tailCache // records recently appended while the segment is active
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
+		keys:       make(map[string]uint64),
 	}
-	storeFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	storeFlag, indexFlag := os.O_RDWR|os.O_CREATE|os.O_APPEND, os.O_RDWR|os.O_CREATE
+	if c.ReadOnly {
+		storeFlag, indexFlag = os.O_RDONLY, os.O_RDONLY
+	}
+	fs := c.fs()
+	storeFile, err := fs.OpenFile(segmentPath(dir, baseOffset, ".store"), storeFlag, 0644)
 	if err != nil {
 		return nil, err
 	}
-	if s.store, err = newStore(storeFile); err != nil {
+	if s.store, err = newStore(storeFile, c); err != nil {
 		return nil, err
 	}
-	indexFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")), os.O_RDWR|os.O_CREATE, 0644)
+	indexFile, err := fs.OpenFile(segmentPath(dir, baseOffset, ".index"), indexFlag, 0644)
 	if err != nil {
 		return nil, err
 	}
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
+	if err = s.recover(); err != nil {
+		return nil, err
+	}
 	if off, _, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
 	} else {
@@ -44,14 +61,32 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	return s, nil
 }
 
+// Sync waits for the segment's records and index entries to be persisted.
+// The store is persisted first, so that the index never points at records which were lost.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
 // Append appends the given record in the segment's store and saves its offset and position in the index.
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	currentOffset := s.nextOffset
 	record.Offset = currentOffset
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
+	if record.Checksum, err = checksum(record); err != nil {
+		return 0, err
+	}
 	p, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
 	}
+	if max := s.config.Limits.MaxRecordBytes; max != 0 && uint64(len(p)) > max {
+		return 0, api.ErrorRecordTooLarge{Size: uint64(len(p)), Max: max}
+	}
 	_, pos, err := s.store.Append(p)
 	if err != nil {
 		return 0, err
@@ -60,11 +95,48 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 		return 0, err
 	}
 	s.nextOffset += 1
+	if n := s.config.Cache.TailRecords; n != 0 {
+		if s.tail == nil {
+			s.tail = newTailCache(n)
+		}
+		s.tail.add(currentOffset, p)
+	}
+	s.observe(record)
 	return currentOffset, nil
 }
 
+// observe updates the segment's in-memory state, such as its key index, with a record stored in the segment.
+func (s *segment) observe(record *api.Record) {
+	s.observeExpiry(record)
+	s.observeKey(record)
+	if s.oldest == 0 || record.Timestamp < s.oldest {
+		s.oldest = record.Timestamp
+	}
+	if record.Timestamp > s.newest {
+		s.newest = record.Timestamp
+	}
+}
+
+// load rebuilds the segment's in-memory state from its records.
+func (s *segment) load(fn func(*api.Record)) error {
+	s.expiresAt, s.persistent = 0, false
+	s.keys, s.bloom = make(map[string]uint64), nil
+	s.oldest, s.newest = 0, 0
+	return s.scan(func(record *api.Record) error {
+		s.observe(record)
+		fn(record)
+		return nil
+	})
+}
+
 // Read returns the record stored in the segment at the specified offset.
 func (s *segment) Read(offset uint64) (*api.Record, error) {
+	if s.tail != nil {
+		if b, ok := s.tail.get(offset); ok {
+			record := &api.Record{}
+			return record, proto.Unmarshal(b, record)
+		}
+	}
 	relativeOffset := offset - s.baseOffset
 	_, recordPosition, err := s.index.Read(int64(relativeOffset))
 	if err != nil {
@@ -79,6 +151,42 @@ func (s *segment) Read(offset uint64) (*api.Record, error) {
 	return record, err
 }
 
+// TruncateAfter discards all records with an offset greater than the given offset.
+// The truncation is persisted, so that a crash cannot bring back the discarded records.
+func (s *segment) TruncateAfter(offset uint64) error {
+	if offset+1 >= s.nextOffset {
+		return nil
+	}
+	relativeOffset := uint32(offset + 1 - s.baseOffset)
+	_, pos, err := s.index.Read(int64(relativeOffset))
+	if err != nil {
+		return err
+	}
+	if err = s.store.Truncate(pos); err != nil {
+		return err
+	}
+	s.index.Truncate(relativeOffset)
+	s.nextOffset = offset + 1
+	if s.tail != nil {
+		s.tail.truncateAfter(offset)
+	}
+	return s.Sync()
+}
+
+// scan calls fn for every record in the segment, in offset order.
+func (s *segment) scan(fn func(*api.Record) error) error {
+	for off := s.baseOffset; off < s.nextOffset; off++ {
+		record, err := s.Read(off)
+		if err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // IsMaxed returns whether the segment has reached its max size.
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes || s.index.size >= s.config.Segment.MaxIndexBytes
@@ -89,10 +197,15 @@ func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
 	}
-	if err := os.Remove(s.index.Name()); err != nil {
+	fs := s.config.fs()
+	if err := fs.Remove(s.index.Name()); err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := fs.Remove(s.store.Name()); err != nil {
+		return err
+	}
+	gap := strings.TrimSuffix(s.store.Name(), ".store") + gapExt
+	if err := fs.Remove(gap); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	return nil
@@ -109,6 +222,11 @@ func (s *segment) Close() error {
 	return nil
 }
 
+// segmentPath returns the path of the segment's file with the given extension.
+func segmentPath(dir string, baseOffset uint64, ext string) string {
+	return path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+}
+
 func nearestMultiple(j, k uint64) uint64 {
 	return (j / k) * k
 }
@@ -0,0 +1,47 @@
+package log
+
+// Stats describes the segments of a log and the space they take.
+type Stats struct {
+	SegmentCount int
+	TotalBytes   uint64 // bytes taken by the stores and the used part of the indexes
+	PendingBytes uint64 // bytes appended but still buffered in memory
+	Segments     []SegmentStats
+}
+
+// SegmentStats describes a segment of the log.
+type SegmentStats struct {
+	BaseOffset      uint64
+	NextOffset      uint64
+	StoreBytes      uint64
+	IndexBytes      uint64
+	Sealed          bool
+	OldestTimestamp int64 // Unix time in nanoseconds of the segment's oldest record, zero if it is empty
+	NewestTimestamp int64
+	PendingBytes    uint64
+}
+
+// Stats returns the log's segment count, sizes and per-segment statistics.
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stats := Stats{
+		SegmentCount: len(l.segments),
+		Segments:     make([]SegmentStats, 0, len(l.segments)),
+	}
+	for _, seg := range l.segments {
+		s := SegmentStats{
+			BaseOffset:      seg.baseOffset,
+			NextOffset:      seg.nextOffset,
+			StoreBytes:      seg.store.size,
+			IndexBytes:      seg.index.size,
+			Sealed:          seg != l.activeSegment,
+			OldestTimestamp: seg.oldest,
+			NewestTimestamp: seg.newest,
+			PendingBytes:    seg.store.Buffered(),
+		}
+		stats.TotalBytes += s.StoreBytes + s.IndexBytes
+		stats.PendingBytes += s.PendingBytes
+		stats.Segments = append(stats.Segments, s)
+	}
+	return stats
+}
@@ -3,7 +3,7 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
-	"os"
+	"fmt"
 	"sync"
 	//"golang.org/x/tools/go/analysis/passes/nilfunc"
 )
@@ -28,22 +28,24 @@ const (
 // 		Offset: 2, Position: 10, Record: len=4, data='ball'
 // Offset and Position for a record form an index entry stored in the index struct.
 type store struct {
-	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
-	size uint64
+	File
+	mu             sync.Mutex
+	buf            *bufio.Writer
+	size           uint64
+	maxRecordBytes uint64
 }
 
-func newStore(f *os.File) (*store, error) {
-	fi, err := os.Stat(f.Name())
+func newStore(f File, c Config) (*store, error) {
+	fi, err := c.fs().Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
 	size := uint64(fi.Size())
 	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
+		File:           f,
+		size:           size,
+		buf:            bufio.NewWriter(f),
+		maxRecordBytes: c.Limits.MaxRecordBytes,
 	}, nil
 }
 
@@ -68,6 +70,8 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 }
 
 // Read returns the record stored at the given position.
+// A stored length beyond the end of the store or above the record size limit is reported as ErrCorrupt,
+// rather than trusted for an allocation.
 func (s *store) Read(pos uint64) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -78,7 +82,14 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
 		return nil, err
 	}
-	b := make([]byte, enc.Uint64(size))
+	n := enc.Uint64(size)
+	if s.maxRecordBytes != 0 && n > s.maxRecordBytes {
+		return nil, fmt.Errorf("%w: record length %d at position %d exceeds the limit of %d bytes", ErrCorrupt, n, pos, s.maxRecordBytes)
+	}
+	if n > s.size-pos-lenWidth {
+		return nil, fmt.Errorf("%w: record length %d at position %d is beyond the end of the store", ErrCorrupt, n, pos)
+	}
+	b := make([]byte, n)
 	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
 		return nil, err
 	}
@@ -95,6 +106,37 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// Sync writes the buffered records to the file and waits for the file to be persisted.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// Buffered returns the number of appended bytes which have not been written to the file yet.
+func (s *store) Buffered() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uint64(s.buf.Buffered())
+}
+
+// Truncate discards all data in the store from the given position onwards.
+func (s *store) Truncate(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(pos)); err != nil {
+		return err
+	}
+	s.size = pos
+	return nil
+}
+
 // Close safely closes the store's file. It persists any buffered data before closing.
 func (s *store) Close() error {
 	s.mu.Lock()
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -18,14 +19,14 @@ func TestStoreAppendRead(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
 
-	s, err := newStore(f)
+	s, err := newStore(f, Config{})
 	require.NoError(t, err)
 
 	testAppend(t, s)
 	testRead(t, s)
 	testReadAt(t, s)
 
-	s, err = newStore(f)
+	s, err = newStore(f, Config{})
 	require.NoError(t, err)
 	testRead(t, s)
 }
@@ -68,4 +69,33 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreReadCorruptLength(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_corrupt_length_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Limits.MaxRecordBytes = 64
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	_, err = s.Read(0) // flushes the buffered record
+	require.NoError(t, err)
+
+	// a length beyond the end of the store
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, 1<<40)
+	_, err = s.File.WriteAt(b, 0)
+	require.NoError(t, err)
+	_, err = s.Read(0)
+	require.True(t, errors.Is(err, ErrCorrupt))
+
+	// a length above the record size limit
+	_, _, err = s.Append(make([]byte, 100))
+	require.NoError(t, err)
+	_, err = s.Read(width)
+	require.True(t, errors.Is(err, ErrCorrupt))
+}
+
 // TODO: Test store.Close() method
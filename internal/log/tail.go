@@ -0,0 +1,47 @@
+package log
+
+// tailCache holds the marshaled records most recently appended to the active segment, so that consumers tailing
+// the log read them from memory instead of flushing the store's write buffer and taking the store's lock. Reads
+// still hold the log's read lock, which also guards the cache: it is only changed under the log's write lock.
+type tailCache struct {
+	records [][]byte
+	start   int    // position of the oldest cached record in records
+	count   int    // number of cached records
+	base    uint64 // offset of the oldest cached record
+}
+
+func newTailCache(size uint64) *tailCache {
+	return &tailCache{records: make([][]byte, size)}
+}
+
+// add caches the record appended at the given offset, evicting the oldest record if the cache is full.
+// Records must be added in offset order.
+func (c *tailCache) add(offset uint64, b []byte) {
+	if c.count == 0 {
+		c.base = offset
+	}
+	if c.count == len(c.records) {
+		c.records[c.start] = nil
+		c.start = (c.start + 1) % len(c.records)
+		c.count--
+		c.base++
+	}
+	c.records[(c.start+c.count)%len(c.records)] = b
+	c.count++
+}
+
+// get returns the cached record at the given offset, if any.
+func (c *tailCache) get(offset uint64) ([]byte, bool) {
+	if offset < c.base || offset >= c.base+uint64(c.count) {
+		return nil, false
+	}
+	return c.records[(c.start+int(offset-c.base))%len(c.records)], true
+}
+
+// truncateAfter drops the cached records with an offset greater than the given offset.
+func (c *tailCache) truncateAfter(offset uint64) {
+	for c.count > 0 && c.base+uint64(c.count)-1 > offset {
+		c.count--
+		c.records[(c.start+c.count)%len(c.records)] = nil
+	}
+}
@@ -0,0 +1,160 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/kartpop/dclog/api/v1"
+)
+
+type txnStatus int
+
+const (
+	txnOpen txnStatus = iota
+	txnAborted
+)
+
+// txn tracks the offset and the timestamp of a transaction's begin marker and whether the transaction has been
+// aborted. Committed transactions are forgotten, as are aborted ones once their abort marker is truncated.
+type txn struct {
+	first  uint64
+	began  int64  // timestamp of the begin marker
+	end    uint64 // offset of the abort marker
+	status txnStatus
+}
+
+// BeginTxn starts a new transaction by writing a begin marker to the log and returns the transaction's ID.
+// Records are added to the transaction by appending them with the transaction's ID. A transaction still open
+// after Config.Txn.Timeout is aborted by the log. A transaction only spans the records of this log, so records of
+// several topics cannot be committed together.
+func (l *Log) BeginTxn() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id := l.nextTxnID
+	if _, err := l.append(&api.Record{TxnId: id, Control: api.Control_CONTROL_BEGIN}); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// CommitTxn writes a commit marker for an open transaction, making its records visible to read-committed consumers.
+// It returns the offset of the marker.
+func (l *Log) CommitTxn(id uint64) (uint64, error) {
+	return l.endTxn(id, api.Control_CONTROL_COMMIT)
+}
+
+// AbortTxn writes an abort marker for an open transaction, hiding its records from read-committed consumers.
+// It returns the offset of the marker.
+func (l *Log) AbortTxn(id uint64) (uint64, error) {
+	return l.endTxn(id, api.Control_CONTROL_ABORT)
+}
+
+func (l *Log) endTxn(id uint64, control api.Control) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkTxn(&api.Record{TxnId: id}); err != nil {
+		return 0, err
+	}
+	return l.append(&api.Record{TxnId: id, Control: control})
+}
+
+// checkTxn verifies that a record appended by a producer is not a control record and belongs to an open
+// transaction, if any.
+func (l *Log) checkTxn(record *api.Record) error {
+	if record.Control != api.Control_CONTROL_NONE {
+		return api.ErrorControlRecord{}
+	}
+	if record.TxnId == 0 {
+		return nil
+	}
+	if t, ok := l.txns[record.TxnId]; !ok || t.status != txnOpen {
+		return api.ErrorTxnNotOpen{TxnID: record.TxnId}
+	}
+	return nil
+}
+
+// trackTxn updates the state of transactions with a record which was appended to the log.
+func (l *Log) trackTxn(record *api.Record) {
+	if record.TxnId >= l.nextTxnID {
+		l.nextTxnID = record.TxnId + 1
+	}
+	switch record.Control {
+	case api.Control_CONTROL_BEGIN:
+		l.txns[record.TxnId] = &txn{first: record.Offset, began: record.Timestamp, status: txnOpen}
+	case api.Control_CONTROL_COMMIT:
+		delete(l.txns, record.TxnId)
+	case api.Control_CONTROL_ABORT:
+		t, ok := l.txns[record.TxnId]
+		if !ok { // the begin marker was truncated
+			t = &txn{first: record.Offset}
+			l.txns[record.TxnId] = t
+		}
+		t.status = txnAborted
+		t.end = record.Offset
+	}
+}
+
+// abortTimedOutTxns aborts the open transactions which began more than Config.Txn.Timeout ago, so that an
+// abandoned transaction does not hold back read-committed consumers. It is called periodically when the timeout
+// is set.
+func (l *Log) abortTimedOutTxns() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	began := time.Now().Add(-l.Config.Txn.Timeout).UnixNano()
+	for id, t := range l.txns {
+		if t.status != txnOpen || t.began > began {
+			continue
+		}
+		if _, err := l.append(&api.Record{TxnId: id, Control: api.Control_CONTROL_ABORT}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneTxns forgets the aborted transactions whose abort marker, and so every record, was removed from the log.
+func (l *Log) pruneTxns() {
+	lowest := l.segments[0].baseOffset
+	for id, t := range l.txns {
+		if t.status == txnAborted && t.end < lowest {
+			delete(l.txns, id)
+		}
+	}
+}
+
+// lastStableOffset returns the offset below which every transaction has been committed or aborted.
+func (l *Log) lastStableOffset() uint64 {
+	lso := l.segments[len(l.segments)-1].nextOffset
+	for _, t := range l.txns {
+		if t.status == txnOpen && t.first < lso {
+			lso = t.first
+		}
+	}
+	return lso
+}
+
+// ReadCommitted returns the first record at or after the given offset which is visible with read-committed isolation.
+// Transaction markers, expired records, records of aborted transactions and gaps in the log's offsets are skipped,
+// and records at or beyond the first open transaction are not returned until the transaction ends.
+func (l *Log) ReadCommitted(offset uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	lso := l.lastStableOffset()
+	for off := l.skipGap(offset); off < lso; off = l.skipGap(off + 1) {
+		record, err := l.read(off)
+		if err != nil {
+			return nil, err
+		}
+		if record.Control != api.Control_CONTROL_NONE || expired(record, now) {
+			continue
+		}
+		if t, ok := l.txns[record.TxnId]; ok && t.status == txnAborted {
+			continue
+		}
+		return record, nil
+	}
+	return nil, api.ErrorOffsetOutOfRange{Offset: offset}
+}
@@ -0,0 +1,155 @@
+package offset
+
+import (
+	"sync"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"github.com/kartpop/dclog/internal/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// Config configures the internal log backing the offset store and how often it is compacted.
+type Config struct {
+	Log log.Config
+	// CompactAfter is the number of stale commits tolerated in the internal log before it is compacted.
+	CompactAfter uint64
+}
+
+type key struct {
+	group     string
+	topic     string
+	partition uint32
+}
+
+// Store persists the offsets committed by consumer groups, keyed by group, topic and partition.
+//
+// Every commit is appended to an internal log. The latest offset per key is kept in memory and rebuilt
+// from the internal log on startup. The internal log is compacted by appending a snapshot of the latest
+// offsets and truncating the segments preceding the snapshot.
+type Store struct {
+	mu sync.Mutex
+
+	log     *log.Log
+	config  Config
+	offsets map[key]uint64
+	stale   uint64 // number of commits in the internal log superseded by a later commit
+}
+
+// NewStore opens the offset store in dir, replaying the internal log to restore committed offsets.
+func NewStore(dir string, c Config) (*Store, error) {
+	if c.CompactAfter == 0 {
+		c.CompactAfter = 1024
+	}
+	l, err := log.NewLog(dir, c.Log)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		log:     l,
+		config:  c,
+		offsets: make(map[key]uint64),
+	}
+	return s, s.replay()
+}
+
+// replay rebuilds the in-memory offsets from the records of the internal log, up to its highest offset. Gaps in
+// the log's offsets, as left by a quarantined segment, are skipped.
+func (s *Store) replay() error {
+	lowest, err := s.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	highest, err := s.log.HighestOffset()
+	if err != nil {
+		return err
+	}
+	for off := s.log.SkipGap(lowest); off <= highest; off = s.log.SkipGap(off + 1) {
+		record, err := s.log.Read(off)
+		if _, ok := err.(api.ErrorOffsetOutOfRange); ok && off == 0 {
+			// an empty log starting at offset 0 reports 0 as its highest offset
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		commit := &api.OffsetCommit{}
+		if err = proto.Unmarshal(record.Value, commit); err != nil {
+			return err
+		}
+		k := key{commit.Group, commit.Topic, commit.Partition}
+		if _, ok := s.offsets[k]; ok {
+			s.stale++
+		}
+		s.offsets[k] = commit.Offset
+	}
+	return nil
+}
+
+// Commit records offset as the committed offset of the group for the given topic and partition.
+// By convention the committed offset is the offset of the next record the group will consume.
+func (s *Store) Commit(group, topic string, partition uint32, offset uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(&api.OffsetCommit{Group: group, Topic: topic, Partition: partition, Offset: offset}); err != nil {
+		return err
+	}
+	k := key{group, topic, partition}
+	if _, ok := s.offsets[k]; ok {
+		s.stale++
+	}
+	s.offsets[k] = offset
+	if s.stale >= s.config.CompactAfter {
+		return s.compact()
+	}
+	return nil
+}
+
+// Fetch returns the offset last committed by the group for the given topic and partition.
+func (s *Store) Fetch(group, topic string, partition uint32) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	off, ok := s.offsets[key{group, topic, partition}]
+	if !ok {
+		return 0, api.ErrorNoCommittedOffset{Group: group, Topic: topic, Partition: partition}
+	}
+	return off, nil
+}
+
+// append writes a commit to the internal log.
+func (s *Store) append(commit *api.OffsetCommit) error {
+	b, err := proto.Marshal(commit)
+	if err != nil {
+		return err
+	}
+	_, err = s.log.Append(&api.Record{Value: b})
+	return err
+}
+
+// compact appends the latest offset of every key and removes the segments which only hold older commits.
+func (s *Store) compact() error {
+	last, err := s.log.HighestOffset()
+	if err != nil {
+		return err
+	}
+	for k, off := range s.offsets {
+		if err := s.append(&api.OffsetCommit{Group: k.group, Topic: k.topic, Partition: k.partition, Offset: off}); err != nil {
+			return err
+		}
+	}
+	s.stale = 0
+	return s.log.Truncate(last)
+}
+
+// Close closes the internal log.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+// Remove closes the store and removes the internal log.
+func (s *Store) Remove() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Remove()
+}
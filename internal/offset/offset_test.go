@@ -0,0 +1,87 @@
+package offset
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"github.com/kartpop/dclog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offset-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{CompactAfter: 4}
+	c.Log.Segment.MaxStoreBytes = 64
+	s, err := NewStore(dir, c)
+	require.NoError(t, err)
+
+	// fetching before any commit fails
+	_, err = s.Fetch("group", "topic", 0)
+	require.Equal(t, api.ErrorNoCommittedOffset{Group: "group", Topic: "topic", Partition: 0}, err)
+
+	// latest commit per key wins
+	for i := uint64(0); i < 10; i++ {
+		require.NoError(t, s.Commit("group", "topic", 0, i))
+	}
+	require.NoError(t, s.Commit("group", "topic", 1, 42))
+	off, err := s.Fetch("group", "topic", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+
+	// compaction removed the segments holding only stale commits
+	lowest, err := s.log.LowestOffset()
+	require.NoError(t, err)
+	require.NotEqual(t, uint64(0), lowest)
+
+	// committed offsets survive a restart
+	require.NoError(t, s.Close())
+	s, err = NewStore(dir, c)
+	require.NoError(t, err)
+	off, err = s.Fetch("group", "topic", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+	off, err = s.Fetch("group", "topic", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), off)
+	require.NoError(t, s.Remove())
+}
+
+func TestStoreReplaySkipsGaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offset-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// commits at offsets 0 and 5, with a gap between them as left by a quarantined segment
+	var lines bytes.Buffer
+	enc := json.NewEncoder(&lines)
+	for _, commit := range []*api.OffsetCommit{
+		{Group: "group", Topic: "topic", Partition: 0, Offset: 3},
+		{Group: "group", Topic: "topic", Partition: 1, Offset: 7},
+	} {
+		b, err := proto.Marshal(commit)
+		require.NoError(t, err)
+		require.NoError(t, enc.Encode(log.ExportedRecord{Offset: uint64(5 * commit.Partition), Value: base64.StdEncoding.EncodeToString(b)}))
+	}
+	c := Config{}
+	l, err := log.NewLog(dir, c.Log)
+	require.NoError(t, err)
+	_, err = log.Import(l, &lines, log.ImportOptions{PreserveOffsets: true})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	s, err := NewStore(dir, c)
+	require.NoError(t, err)
+	defer s.Close()
+	off, err := s.Fetch("group", "topic", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+}
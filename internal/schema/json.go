@@ -0,0 +1,166 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// jsonValidator checks that record values are JSON documents conforming to a JSON Schema.
+type jsonValidator struct {
+	schema *jsonschema.Schema
+}
+
+func newJSONValidator(s *api.Schema) (*jsonValidator, error) {
+	c := jsonschema.NewCompiler()
+	// references are resolved within the document only, so that a schema cannot make the server fetch files or URLs
+	c.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("cannot load %s: external references are not supported", url)
+	}
+	if err := c.AddResource("schema.json", bytes.NewReader(s.Definition)); err != nil {
+		return nil, api.ErrorInvalidSchema{Reason: err.Error()}
+	}
+	schema, err := c.Compile("schema.json")
+	if err != nil {
+		return nil, api.ErrorInvalidSchema{Reason: err.Error()}
+	}
+	return &jsonValidator{schema: schema}, nil
+}
+
+// validate parses the value as a single JSON document and validates it against the schema.
+func (v *jsonValidator) validate(value []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("value is not JSON: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("value holds data after the JSON document")
+	}
+	return v.schema.Validate(doc)
+}
+
+// canReadJSON returns why values written with the writer schema cannot be read with the reader schema, if so.
+//
+// Only the structure of objects is compared: the types of their properties, the properties they require and
+// whether they allow additional properties. Other keywords, such as formats and bounds, are not checked.
+func canReadJSON(reader, writer *api.Schema) (string, error) {
+	var r, w map[string]interface{}
+	if err := json.Unmarshal(reader.Definition, &r); err != nil {
+		return "", api.ErrorInvalidSchema{Reason: err.Error()}
+	}
+	if err := json.Unmarshal(writer.Definition, &w); err != nil {
+		return "", api.ErrorInvalidSchema{Reason: err.Error()}
+	}
+	return canReadJSONValue("", r, w), nil
+}
+
+// canReadJSONValue compares the schemas of the values at the given JSON pointer.
+func canReadJSONValue(at string, r, w map[string]interface{}) string {
+	rTypes, wTypes := jsonTypes(r), jsonTypes(w)
+	if rTypes != nil {
+		if wTypes == nil {
+			return fmt.Sprintf("%s is restricted to %v", location(at), sortedKeys(rTypes))
+		}
+		for t := range wTypes {
+			if !rTypes[t] && !(t == "integer" && rTypes["number"]) {
+				return fmt.Sprintf("%s may be of type %s", location(at), t)
+			}
+		}
+	}
+
+	rProps, wProps := jsonObject(r["properties"]), jsonObject(w["properties"])
+	wRequired := map[string]bool{}
+	for _, name := range jsonStrings(w["required"]) {
+		wRequired[name] = true
+	}
+	for _, name := range jsonStrings(r["required"]) {
+		if !wRequired[name] {
+			return fmt.Sprintf("property %s/%s is required but not always written", at, name)
+		}
+	}
+	if additional, ok := r["additionalProperties"].(bool); ok && !additional {
+		for _, name := range sortedKeys(wProps) {
+			if _, ok := rProps[name]; !ok {
+				return fmt.Sprintf("property %s/%s is not allowed", at, name)
+			}
+		}
+	}
+	for _, name := range sortedKeys(rProps) {
+		rProp, rOK := rProps[name].(map[string]interface{})
+		wProp, wOK := wProps[name].(map[string]interface{})
+		if !rOK || !wOK {
+			continue
+		}
+		if reason := canReadJSONValue(at+"/"+name, rProp, wProp); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// jsonTypes returns the set of types allowed by a schema's type keyword, or nil if any type is allowed.
+func jsonTypes(schema map[string]interface{}) map[string]bool {
+	switch t := schema["type"].(type) {
+	case string:
+		return map[string]bool{t: true}
+	case []interface{}:
+		types := map[string]bool{}
+		for _, name := range jsonStrings(t) {
+			types[name] = true
+		}
+		return types
+	}
+	return nil
+}
+
+// jsonObject returns the value as a JSON object, or an empty object if it is not one.
+func jsonObject(v interface{}) map[string]interface{} {
+	if o, ok := v.(map[string]interface{}); ok {
+		return o
+	}
+	return map[string]interface{}{}
+}
+
+// jsonStrings returns the strings of a JSON array.
+func jsonStrings(v interface{}) []string {
+	a, _ := v.([]interface{})
+	var strs []string
+	for _, e := range a {
+		if s, ok := e.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
+
+// location describes a JSON pointer for an error message.
+func location(at string) string {
+	if at == "" {
+		return "the value"
+	}
+	return "property " + at
+}
+
+// sortedKeys returns the keys of a map in order, so that comparisons report the same difference every time.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]bool:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]interface{}:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
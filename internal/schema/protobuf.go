@@ -0,0 +1,156 @@
+package schema
+
+import (
+	"fmt"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoValidator checks that record values are messages of a protobuf schema.
+type protoValidator struct {
+	message protoreflect.MessageDescriptor
+}
+
+func newProtoValidator(s *api.Schema) (*protoValidator, error) {
+	md, err := protoMessage(s)
+	if err != nil {
+		return nil, err
+	}
+	return &protoValidator{message: md}, nil
+}
+
+// protoMessage returns the descriptor of the schema's message. The schema's definition must be a descriptor set
+// holding the message's file and all of its dependencies.
+func protoMessage(s *api.Schema) (protoreflect.MessageDescriptor, error) {
+	fds := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(s.Definition, fds); err != nil {
+		return nil, api.ErrorInvalidSchema{Reason: fmt.Sprintf("reading descriptor set: %v", err)}
+	}
+	files, err := protodesc.NewFiles(fds)
+	if err != nil {
+		return nil, api.ErrorInvalidSchema{Reason: fmt.Sprintf("reading descriptor set: %v", err)}
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(s.MessageName))
+	if err != nil {
+		return nil, api.ErrorInvalidSchema{Reason: fmt.Sprintf("message %q not found in the descriptor set", s.MessageName)}
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, api.ErrorInvalidSchema{Reason: fmt.Sprintf("%q is not a message", s.MessageName)}
+	}
+	return md, nil
+}
+
+// validate unmarshals the value as the schema's message and rejects it if it lacks required fields or holds
+// fields the schema does not define.
+func (v *protoValidator) validate(value []byte) error {
+	m := dynamicpb.NewMessage(v.message)
+	if err := (proto.UnmarshalOptions{AllowPartial: true}).Unmarshal(value, m); err != nil {
+		return err
+	}
+	if err := proto.CheckInitialized(m); err != nil {
+		return err
+	}
+	return checkUnknown(m)
+}
+
+// checkUnknown returns an error for the first field of the message, or of its nested messages, which is not
+// defined by the schema.
+func checkUnknown(m protoreflect.Message) error {
+	if unknown := m.GetUnknown(); len(unknown) > 0 {
+		num, _, _ := protowire.ConsumeTag(unknown)
+		return fmt.Errorf("field number %d is not defined in %s", num, m.Descriptor().FullName())
+	}
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			for i := 0; i < v.List().Len() && err == nil; i++ {
+				err = checkUnknown(v.List().Get(i).Message())
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+				err = checkUnknown(v.Message())
+				return err == nil
+			})
+		case !fd.IsList() && !fd.IsMap() && fd.Message() != nil:
+			err = checkUnknown(v.Message())
+		}
+		return err == nil
+	})
+	return err
+}
+
+// canReadProto returns why values written with the writer schema cannot be read with the reader schema, if so.
+func canReadProto(reader, writer *api.Schema) (string, error) {
+	r, err := protoMessage(reader)
+	if err != nil {
+		return "", err
+	}
+	w, err := protoMessage(writer)
+	if err != nil {
+		return "", err
+	}
+	return canReadMessage(r, w, map[protoreflect.FullName]bool{}), nil
+}
+
+// canReadMessage compares the fields of the messages read and written: fields sharing a number must have the same
+// type, and fields required by the reader must be written.
+func canReadMessage(r, w protoreflect.MessageDescriptor, seen map[protoreflect.FullName]bool) string {
+	if seen[r.FullName()] {
+		return ""
+	}
+	seen[r.FullName()] = true
+	for i := 0; i < r.Fields().Len(); i++ {
+		rf := r.Fields().Get(i)
+		wf := w.Fields().ByNumber(rf.Number())
+		if wf == nil {
+			if rf.Cardinality() == protoreflect.Required {
+				return fmt.Sprintf("required field %s is not written", rf.FullName())
+			}
+			continue
+		}
+		if rf.Cardinality() == protoreflect.Required && wf.Cardinality() != protoreflect.Required {
+			return fmt.Sprintf("required field %s is optional when written", rf.FullName())
+		}
+		if rf.Kind() != wf.Kind() || rf.IsList() != wf.IsList() || rf.IsMap() != wf.IsMap() {
+			return fmt.Sprintf("field number %d of %s changed type", rf.Number(), r.FullName())
+		}
+		switch {
+		case rf.IsMap():
+			if reason := canReadValue(rf.MapValue(), wf.MapValue(), seen); reason != "" {
+				return reason
+			}
+		default:
+			if reason := canReadValue(rf, wf, seen); reason != "" {
+				return reason
+			}
+		}
+	}
+	return ""
+}
+
+// canReadValue compares the message or enum types of fields sharing a number.
+func canReadValue(rf, wf protoreflect.FieldDescriptor, seen map[protoreflect.FullName]bool) string {
+	if rf.Kind() != wf.Kind() {
+		return fmt.Sprintf("field %s changed type", rf.FullName())
+	}
+	switch {
+	case rf.Message() != nil:
+		if rf.Message().FullName() != wf.Message().FullName() {
+			return fmt.Sprintf("field %s changed from %s to %s", rf.FullName(), wf.Message().FullName(), rf.Message().FullName())
+		}
+		return canReadMessage(rf.Message(), wf.Message(), seen)
+	case rf.Enum() != nil:
+		if rf.Enum().FullName() != wf.Enum().FullName() {
+			return fmt.Sprintf("field %s changed from %s to %s", rf.FullName(), wf.Enum().FullName(), rf.Enum().FullName())
+		}
+	}
+	return ""
+}
@@ -0,0 +1,200 @@
+package schema
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// schemaExt is the extension of the files the schema versions are stored in.
+const schemaExt = ".schema"
+
+// Registry keeps the versions of a log's schema and validates record values against the latest version.
+// Every version is stored in its own file of the registry's directory, which is usually kept next to the log's.
+type Registry struct {
+	mu       sync.RWMutex
+	Dir      string
+	versions []*api.Schema
+	latest   validator
+}
+
+// validator checks record values against a schema version.
+type validator interface {
+	validate(value []byte) error
+}
+
+// NewRegistry loads the schema versions stored in dir, creating the directory if needed.
+func NewRegistry(dir string) (*Registry, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &Registry{Dir: dir}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var versions []uint32
+	for _, file := range files {
+		if path.Ext(file.Name()) != schemaExt {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), schemaExt), 10, 32)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, uint32(v))
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	for i, v := range versions {
+		if v != uint32(i+1) {
+			return nil, fmt.Errorf("schema version %d is missing from %s", i+1, dir)
+		}
+		b, err := ioutil.ReadFile(r.path(v))
+		if err != nil {
+			return nil, err
+		}
+		s := &api.Schema{}
+		if err = proto.Unmarshal(b, s); err != nil {
+			return nil, fmt.Errorf("reading schema version %d: %w", v, err)
+		}
+		r.versions = append(r.versions, s)
+	}
+	if n := len(r.versions); n > 0 {
+		if r.latest, err = compile(r.versions[n-1]); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Register stores a new version of the schema and returns its version number. The new version must be valid and
+// satisfy the given compatibility with the latest version; it is then enforced on the values validated.
+func (r *Registry) Register(s *api.Schema, c api.Compatibility) (uint32, error) {
+	s = proto.Clone(s).(*api.Schema)
+	v, err := compile(s)
+	if err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := len(r.versions); n > 0 {
+		if err = checkCompatibility(r.versions[n-1], s, c); err != nil {
+			return 0, err
+		}
+	}
+	s.Version = uint32(len(r.versions) + 1)
+	if err = r.write(s); err != nil {
+		return 0, err
+	}
+	r.versions = append(r.versions, s)
+	r.latest = v
+	return s.Version, nil
+}
+
+// Get returns the given version of the schema, or the latest version for version zero.
+func (r *Registry) Get(version uint32) (*api.Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if version == 0 {
+		version = uint32(len(r.versions))
+	}
+	if version == 0 || version > uint32(len(r.versions)) {
+		return nil, api.ErrorSchemaNotFound{Version: version}
+	}
+	return proto.Clone(r.versions[version-1]).(*api.Schema), nil
+}
+
+// Validate checks a record value against the latest version of the schema.
+// It returns api.ErrorSchemaViolation if the value does not conform; any value conforms until a schema is registered.
+func (r *Registry) Validate(value []byte) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.latest == nil {
+		return nil
+	}
+	if err := r.latest.validate(value); err != nil {
+		return api.ErrorSchemaViolation{Version: uint32(len(r.versions)), Reason: err.Error()}
+	}
+	return nil
+}
+
+// write stores a schema version in a temporary file which is renamed once persisted, so that a crash cannot leave
+// a partial version behind.
+func (r *Registry) write(s *api.Schema) error {
+	b, err := proto.Marshal(s)
+	if err != nil {
+		return err
+	}
+	name := r.path(s.Version)
+	f, err := os.OpenFile(name+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(b); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// path returns the path of the file storing the given schema version.
+func (r *Registry) path(version uint32) string {
+	return path.Join(r.Dir, fmt.Sprintf("%d%s", version, schemaExt))
+}
+
+// compile parses a schema into a validator of record values.
+func compile(s *api.Schema) (validator, error) {
+	switch s.Type {
+	case api.SchemaType_SCHEMA_TYPE_PROTOBUF:
+		return newProtoValidator(s)
+	case api.SchemaType_SCHEMA_TYPE_JSON:
+		return newJSONValidator(s)
+	}
+	return nil, api.ErrorInvalidSchema{Reason: fmt.Sprintf("unsupported schema type %s", s.Type)}
+}
+
+// checkCompatibility verifies that values written with either version can be read with the other, as required
+// by the compatibility.
+func checkCompatibility(latest, next *api.Schema, c api.Compatibility) error {
+	if c == api.Compatibility_COMPATIBILITY_NONE {
+		return nil
+	}
+	incompatible := func(reason string) error {
+		return api.ErrorIncompatibleSchema{Latest: latest.Version, Reason: reason}
+	}
+	if latest.Type != next.Type {
+		return incompatible(fmt.Sprintf("schema type changed from %s to %s", latest.Type, next.Type))
+	}
+	canRead := canReadProto
+	if next.Type == api.SchemaType_SCHEMA_TYPE_JSON {
+		canRead = canReadJSON
+	}
+	if c == api.Compatibility_COMPATIBILITY_BACKWARD || c == api.Compatibility_COMPATIBILITY_FULL {
+		if reason, err := canRead(next, latest); err != nil || reason != "" {
+			if err != nil {
+				return err
+			}
+			return incompatible("values written with the latest version cannot be read: " + reason)
+		}
+	}
+	if c == api.Compatibility_COMPATIBILITY_FORWARD || c == api.Compatibility_COMPATIBILITY_FULL {
+		if reason, err := canRead(latest, next); err != nil || reason != "" {
+			if err != nil {
+				return err
+			}
+			return incompatible("values written with the new version cannot be read by the latest one: " + reason)
+		}
+	}
+	return nil
+}
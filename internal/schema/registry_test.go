@@ -0,0 +1,133 @@
+package schema
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// protoSchema returns a schema of the given message of the log's API.
+func protoSchema(t *testing.T, message string) *api.Schema {
+	fds := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(api.File_api_v1_log_proto)},
+	}
+	b, err := proto.Marshal(fds)
+	require.NoError(t, err)
+	return &api.Schema{Type: api.SchemaType_SCHEMA_TYPE_PROTOBUF, Definition: b, MessageName: message}
+}
+
+func TestRegistry(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, r *Registry){
+		"protobuf schema": testProtobuf,
+		"json schema":     testJSON,
+		"invalid schema":  testInvalid,
+		"reopen registry": testReopen,
+		"no schema":       testNoSchema,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "schema-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			r, err := NewRegistry(dir)
+			require.NoError(t, err)
+			fn(t, r)
+		})
+	}
+}
+
+func testProtobuf(t *testing.T, r *Registry) {
+	v, err := r.Register(protoSchema(t, "log.v1.OffsetCommit"), api.Compatibility_COMPATIBILITY_NONE)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), v)
+
+	value, err := proto.Marshal(&api.OffsetCommit{Group: "g", Topic: "t", Offset: 3})
+	require.NoError(t, err)
+	require.NoError(t, r.Validate(value))
+	value, err = proto.Marshal(&api.Record{Checksum: 5}) // field 9 is not defined by OffsetCommit
+	require.NoError(t, err)
+	require.IsType(t, api.ErrorSchemaViolation{}, r.Validate(value))
+	require.Error(t, r.Validate([]byte{0xff}))
+
+	// CommitTxnRequest's first field is an integer where OffsetCommit has a string
+	_, err = r.Register(protoSchema(t, "log.v1.CommitTxnRequest"), api.Compatibility_COMPATIBILITY_BACKWARD)
+	require.IsType(t, api.ErrorIncompatibleSchema{}, err)
+	// FetchOffsetRequest shares OffsetCommit's first fields and reads its values
+	v, err = r.Register(protoSchema(t, "log.v1.FetchOffsetRequest"), api.Compatibility_COMPATIBILITY_BACKWARD)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), v)
+	schema, err := r.Get(0)
+	require.NoError(t, err)
+	require.Equal(t, "log.v1.FetchOffsetRequest", schema.MessageName)
+}
+
+func testJSON(t *testing.T, r *Registry) {
+	jsonSchema := func(definition string) *api.Schema {
+		return &api.Schema{Type: api.SchemaType_SCHEMA_TYPE_JSON, Definition: []byte(definition)}
+	}
+	_, err := r.Register(jsonSchema(`{
+		"type": "object",
+		"properties": {"id": {"type": "integer"}, "name": {"type": "string"}},
+		"required": ["id"],
+		"additionalProperties": false
+	}`), api.Compatibility_COMPATIBILITY_FULL)
+	require.NoError(t, err)
+	require.NoError(t, r.Validate([]byte(`{"id": 1, "name": "a"}`)))
+	for _, value := range []string{`{"name": "a"}`, `{"id": "1"}`, `{"id": 1, "other": true}`, `{"id": 1} {}`, `not json`} {
+		require.IsType(t, api.ErrorSchemaViolation{}, r.Validate([]byte(value)), value)
+	}
+
+	// a new property cannot be read by the latest version, which forbids additional properties
+	next := jsonSchema(`{"type": "object", "properties": {"id": {"type": "number"}, "tag": {"type": "string"}}, "required": ["id"]}`)
+	_, err = r.Register(next, api.Compatibility_COMPATIBILITY_FORWARD)
+	require.IsType(t, api.ErrorIncompatibleSchema{}, err)
+	_, err = r.Register(next, api.Compatibility_COMPATIBILITY_BACKWARD)
+	require.NoError(t, err)
+
+	// a changed type cannot be read in either direction
+	_, err = r.Register(jsonSchema(`{"type": "object", "properties": {"id": {"type": "string"}}}`), api.Compatibility_COMPATIBILITY_BACKWARD)
+	require.IsType(t, api.ErrorIncompatibleSchema{}, err)
+	_, err = r.Register(protoSchema(t, "log.v1.OffsetCommit"), api.Compatibility_COMPATIBILITY_BACKWARD)
+	require.IsType(t, api.ErrorIncompatibleSchema{}, err)
+}
+
+func testInvalid(t *testing.T, r *Registry) {
+	for _, s := range []*api.Schema{
+		{Type: api.SchemaType_SCHEMA_TYPE_NONE},
+		{Type: api.SchemaType_SCHEMA_TYPE_JSON, Definition: []byte(`{"type": 1}`)},
+		{Type: api.SchemaType_SCHEMA_TYPE_JSON, Definition: []byte(`{"$ref": "file:///etc/passwd"}`)},
+		protoSchema(t, "log.v1.Missing"),
+	} {
+		_, err := r.Register(s, api.Compatibility_COMPATIBILITY_NONE)
+		require.IsType(t, api.ErrorInvalidSchema{}, err)
+	}
+	_, err := r.Get(0)
+	require.IsType(t, api.ErrorSchemaNotFound{}, err)
+}
+
+func testReopen(t *testing.T, r *Registry) {
+	for _, message := range []string{"log.v1.OffsetCommit", "log.v1.CommitTxnRequest"} {
+		_, err := r.Register(protoSchema(t, message), api.Compatibility_COMPATIBILITY_NONE)
+		require.NoError(t, err)
+	}
+	r, err := NewRegistry(r.Dir)
+	require.NoError(t, err)
+	schema, err := r.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, "log.v1.OffsetCommit", schema.MessageName)
+	_, err = r.Get(3)
+	require.IsType(t, api.ErrorSchemaNotFound{}, err)
+
+	value, err := proto.Marshal(&api.OffsetCommit{Group: "g"}) // a string where CommitTxnRequest has an integer
+	require.NoError(t, err)
+	require.Error(t, r.Validate(value))
+}
+
+func testNoSchema(t *testing.T, r *Registry) {
+	require.NoError(t, r.Validate([]byte("anything")))
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"github.com/kartpop/dclog/internal/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StatsLog is implemented by commit logs which report statistics about their segments
+type StatsLog interface {
+	Stats() log.Stats
+}
+
+// OffsetRangeLog is implemented by commit logs which report the range of their offsets
+type OffsetRangeLog interface {
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+}
+
+// TruncateLog is implemented by commit logs which remove their oldest records on request
+type TruncateLog interface {
+	Truncate(lowest uint64) error
+}
+
+// TruncateAfterLog is implemented by commit logs which remove their newest records on request
+type TruncateAfterLog interface {
+	TruncateAfter(offset uint64) error
+}
+
+// RollLog is implemented by segmented commit logs which start a new segment on request
+type RollLog interface {
+	Roll() (uint64, error)
+}
+
+// ResetLog is implemented by commit logs which drop all of their records on request
+type ResetLog interface {
+	Reset() error
+}
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+// adminServer implements the AdminServer interface autogenerated by grpc.
+// It exposes the management operations of the commit log.
+type adminServer struct {
+	api.UnimplementedAdminServer
+	*Config
+}
+
+// newadminServer is the factory method returning the adminServer instance
+func newadminServer(config *Config) (srv *adminServer, err error) {
+	srv = &adminServer{
+		Config: config,
+	}
+	return srv, nil
+}
+
+// Stats returns the segment count, sizes and per-segment statistics of the log.
+func (a *adminServer) Stats(ctx context.Context, req *api.StatsRequest) (*api.StatsResponse, error) {
+	statsLog, ok := a.CommitLog.(StatsLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "stats are not supported")
+	}
+	stats := statsLog.Stats()
+	return &api.StatsResponse{
+		SegmentCount: uint64(stats.SegmentCount),
+		TotalBytes:   stats.TotalBytes,
+		PendingBytes: stats.PendingBytes,
+		Segments:     segmentStats(stats.Segments),
+	}, nil
+}
+
+// segmentStats converts the statistics of the log's segments to their api/v1 messages.
+func segmentStats(segments []log.SegmentStats) []*api.SegmentStats {
+	var res []*api.SegmentStats
+	for _, s := range segments {
+		res = append(res, &api.SegmentStats{
+			BaseOffset:      s.BaseOffset,
+			NextOffset:      s.NextOffset,
+			StoreBytes:      s.StoreBytes,
+			IndexBytes:      s.IndexBytes,
+			Sealed:          s.Sealed,
+			OldestTimestamp: s.OldestTimestamp,
+			NewestTimestamp: s.NewestTimestamp,
+			PendingBytes:    s.PendingBytes,
+		})
+	}
+	return res
+}
+
+// GetOffsets returns the lowest and the highest offset of the log.
+func (a *adminServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	rangeLog, ok := a.CommitLog.(OffsetRangeLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "offset ranges are not supported")
+	}
+	lowest, err := rangeLog.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := rangeLog.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetOffsetsResponse{LowestOffset: lowest, HighestOffset: highest}, nil
+}
+
+// ListSegments returns the statistics of the log's segments, oldest first.
+func (a *adminServer) ListSegments(ctx context.Context, req *api.ListSegmentsRequest) (*api.ListSegmentsResponse, error) {
+	statsLog, ok := a.CommitLog.(StatsLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "segments are not supported")
+	}
+	return &api.ListSegmentsResponse{Segments: segmentStats(statsLog.Stats().Segments)}, nil
+}
+
+// Truncate removes the oldest records of the log, whose offsets are lower than the requested one.
+func (a *adminServer) Truncate(ctx context.Context, req *api.TruncateRequest) (*api.TruncateResponse, error) {
+	truncateLog, ok := a.CommitLog.(TruncateLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "truncation is not supported")
+	}
+	if req.Before == 0 {
+		return &api.TruncateResponse{}, nil
+	}
+	if err := truncateLog.Truncate(req.Before - 1); err != nil {
+		return nil, err
+	}
+	return &api.TruncateResponse{}, nil
+}
+
+// TruncateAfter removes the records of the log whose offsets are greater than the requested one.
+func (a *adminServer) TruncateAfter(ctx context.Context, req *api.TruncateAfterRequest) (*api.TruncateAfterResponse, error) {
+	truncateLog, ok := a.CommitLog.(TruncateAfterLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "truncation after an offset is not supported")
+	}
+	if err := truncateLog.TruncateAfter(req.Offset); err != nil {
+		return nil, err
+	}
+	return &api.TruncateAfterResponse{}, nil
+}
+
+// ForceRoll seals the log's active segment and starts a new one.
+func (a *adminServer) ForceRoll(ctx context.Context, req *api.ForceRollRequest) (*api.ForceRollResponse, error) {
+	rollLog, ok := a.CommitLog.(RollLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "segment rolls are not supported")
+	}
+	base, err := rollLog.Roll()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ForceRollResponse{BaseOffset: base}, nil
+}
+
+// Reset drops all records of the log.
+func (a *adminServer) Reset(ctx context.Context, req *api.ResetRequest) (*api.ResetResponse, error) {
+	resetLog, ok := a.CommitLog.(ResetLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "reset is not supported")
+	}
+	if err := resetLog.Reset(); err != nil {
+		return nil, err
+	}
+	return &api.ResetResponse{}, nil
+}
+
+// RegisterSchema registers a new version of the schema of record values, after checking the requested
+// compatibility with the latest version.
+func (a *adminServer) RegisterSchema(ctx context.Context, req *api.RegisterSchemaRequest) (*api.RegisterSchemaResponse, error) {
+	if a.Schemas == nil {
+		return nil, status.Error(codes.Unimplemented, "schemas are not supported")
+	}
+	if req.Schema == nil {
+		return nil, status.Error(codes.InvalidArgument, "schema is required")
+	}
+	version, err := a.Schemas.Register(req.Schema, req.Compatibility)
+	if err != nil {
+		return nil, err
+	}
+	return &api.RegisterSchemaResponse{Version: version}, nil
+}
+
+// GetSchema returns a version of the schema of record values, or the latest version.
+func (a *adminServer) GetSchema(ctx context.Context, req *api.GetSchemaRequest) (*api.GetSchemaResponse, error) {
+	if a.Schemas == nil {
+		return nil, status.Error(codes.Unimplemented, "schemas are not supported")
+	}
+	schema, err := a.Schemas.Get(req.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetSchemaResponse{Schema: schema}, nil
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/kartpop/dclog/internal/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// adminMethodPrefix is the prefix of the full method names of the Admin service.
+const adminMethodPrefix = "/log.v1.Admin/"
+
+// unaryAuthInterceptor rejects the unary calls the client is not authorized to make.
+func (c *Config) unaryAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := c.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamAuthInterceptor rejects the streams the client is not authorized to open.
+func (c *Config) streamAuthInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := c.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// authorize requires the admin role for the methods of the Admin service. Without an Authorizer, no client has
+// the role and the Admin service is closed to all.
+func (c *Config) authorize(ctx context.Context, method string) error {
+	if !strings.HasPrefix(method, adminMethodPrefix) {
+		return nil
+	}
+	if c.Authorizer == nil {
+		return status.Error(codes.PermissionDenied, "the Admin service is disabled: no authorizer is configured")
+	}
+	subject, err := subject(ctx)
+	if err != nil {
+		return err
+	}
+	return c.Authorizer.Authorize(subject, auth.RoleAdmin)
+}
+
+// subject returns the common name of the client's verified TLS certificate.
+func subject(ctx context.Context) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "no peer information")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return "", status.Error(codes.Unauthenticated, "no verified client certificate")
+	}
+	return info.State.VerifiedChains[0][0].Subject.CommonName, nil
+}
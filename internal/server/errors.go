@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"errors"
+	stdlog "log"
+
+	api "github.com/kartpop/dclog/api/v1"
+	"github.com/kartpop/dclog/internal/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// unaryErrorInterceptor maps the errors returned by unary handlers to the errors of api/v1.
+func (c *Config) unaryErrorInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	res, err := handler(ctx, req)
+	return res, c.apiError(info.FullMethod, err)
+}
+
+// streamErrorInterceptor maps the errors returned by stream handlers to the errors of api/v1.
+func (c *Config) streamErrorInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return c.apiError(info.FullMethod, handler(srv, ss))
+}
+
+// apiError converts an error to one which carries a gRPC status, so that clients never see codes.Unknown.
+// Errors which carry a status, such as the errors of api/v1, are kept, even when wrapped. Other errors are
+// logged and sent as an internal error which does not reveal them.
+func (c *Config) apiError(method string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var se interface{ GRPCStatus() *status.Status }
+	var corrupt *log.CorruptionError
+	switch {
+	case errors.As(err, &se):
+		return se.GRPCStatus().Err()
+	case errors.As(err, &corrupt):
+		return api.ErrorCorrupt{Reason: corrupt.Error()}
+	case errors.Is(err, log.ErrCorrupt):
+		return api.ErrorCorrupt{Reason: err.Error()}
+	case errors.Is(err, log.ErrReadOnly):
+		return api.ErrorReadOnly{}
+	case errors.Is(err, log.ErrNotOpen):
+		return api.ErrorNotOpen{}
+	case errors.Is(err, log.ErrLocked):
+		return api.ErrorLocked{}
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	c.logf("%s: %v", method, err)
+	return api.ErrorInternal{}
+}
+
+// logf logs to the ErrorLog, or to the standard logger if there is none.
+func (c *Config) logf(format string, args ...interface{}) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, args...)
+		return
+	}
+	stdlog.Printf(format, args...)
+}
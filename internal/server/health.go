@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kartpop/dclog/internal/log"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// ReadyLog is implemented by commit logs which report whether they can serve requests
+type ReadyLog interface {
+	Ready() error
+}
+
+const (
+	logService   = "log.v1.Log"
+	adminService = "log.v1.Admin"
+	// healthWatchInterval is how often Watch checks for a change of status.
+	healthWatchInterval = time.Second
+)
+
+// healthServer implements the grpc.health.v1 service. Statuses are worked out on every check from the readiness of
+// the log and, in a cluster, whether the cluster has a leader.
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+	*Config
+}
+
+// newhealthServer is the factory method returning the healthServer instance
+func newhealthServer(config *Config) (srv *healthServer, err error) {
+	srv = &healthServer{
+		Config: config,
+	}
+	return srv, nil
+}
+
+// Check returns the status of a service, or of the server as a whole for the empty service name.
+func (h *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	st, ok := h.status(req.Service)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown service: %s", req.Service)
+	}
+	return &healthpb.HealthCheckResponse{Status: st}, nil
+}
+
+// Watch streams the status of a service, sending it first and then whenever it changes.
+func (h *healthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+	last := healthpb.HealthCheckResponse_ServingStatus(-1)
+	for {
+		if st, _ := h.status(req.Service); st != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: st}); err != nil {
+				return err
+			}
+			last = st
+		}
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// status returns the status of a service, and whether the service is known.
+// The Log service, which the server as a whole stands for, serves once the log is open, while its disk is not full
+// and, in a cluster, while the cluster has a leader. The Admin service serves once the log is open, so that space
+// can be freed on a full disk.
+func (h *healthServer) status(service string) (healthpb.HealthCheckResponse_ServingStatus, bool) {
+	var ready error
+	if readyLog, ok := h.CommitLog.(ReadyLog); ok {
+		ready = readyLog.Ready()
+	}
+	switch service {
+	case "", logService:
+		if ready != nil || h.HasLeader != nil && !h.HasLeader() {
+			return healthpb.HealthCheckResponse_NOT_SERVING, true
+		}
+		return healthpb.HealthCheckResponse_SERVING, true
+	case adminService:
+		if errors.Is(ready, log.ErrNotOpen) {
+			return healthpb.HealthCheckResponse_NOT_SERVING, true
+		}
+		return healthpb.HealthCheckResponse_SERVING, true
+	}
+	return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, false
+}
@@ -2,14 +2,41 @@ package server
 
 import (
 	"context"
+	stdlog "log"
+	"time"
 
 	api "github.com/kartpop/dclog/api/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 // Config wraps the interface implemented by the log data structure
 type Config struct {
 	CommitLog CommitLog
+	Offsets   OffsetStore
+	// Schemas, if set, validates the values of produced records and stores the versions of their schema.
+	Schemas SchemaRegistry
+	// Authorizer restricts the Admin service to the clients granted auth.RoleAdmin. Clients are identified by the
+	// common name of their TLS certificate. Without an Authorizer, all calls to the Admin service are denied.
+	Authorizer Authorizer
+	// HasLeader, if set, reports whether the cluster the server belongs to has a leader. The Log service is not
+	// serving, as reported by the health service, while it has none.
+	HasLeader func() bool
+	// Reflection registers the server reflection service, so that tools such as grpcurl can list and call the
+	// server's services.
+	Reflection bool
+	// ErrorLog logs the errors which are sent to clients as internal errors, without their detail. If nil, they
+	// are logged by the standard logger.
+	ErrorLog *stdlog.Logger
+}
+
+// Authorizer is the interface implemented by the store of the roles granted to clients
+type Authorizer interface {
+	Authorize(subject, role string) error
 }
 
 // CommitLog is the interface implemented by the log data structure
@@ -18,15 +45,85 @@ type CommitLog interface {
 	Read(uint64) (*api.Record, error)
 }
 
+// TxnLog is implemented by commit logs which support transactions and read-committed isolation
+type TxnLog interface {
+	BeginTxn() (uint64, error)
+	CommitTxn(uint64) (uint64, error)
+	AbortTxn(uint64) (uint64, error)
+	ReadCommitted(uint64) (*api.Record, error)
+}
+
+// KeyLog is implemented by commit logs which support looking up the latest record for a key
+type KeyLog interface {
+	LookupKey([]byte) (*api.Record, error)
+}
+
+// GapLog is implemented by commit logs whose offsets may have gaps, which consumers skip
+type GapLog interface {
+	SkipGap(offset uint64) uint64
+}
+
+// LimitedLog is implemented by commit logs which cap the size of the records they accept
+type LimitedLog interface {
+	MaxRecordBytes() uint64
+}
+
+// BatchLog is implemented by commit logs which append batches of records atomically
+type BatchLog interface {
+	AppendBatch([]*api.Record) (first, last uint64, err error)
+}
+
+// OffsetStore is the interface implemented by the store of offsets committed by consumer groups
+type OffsetStore interface {
+	Commit(group, topic string, partition uint32, offset uint64) error
+	Fetch(group, topic string, partition uint32) (uint64, error)
+}
+
+// SchemaRegistry is the interface implemented by the registry of the schema which record values must conform to
+type SchemaRegistry interface {
+	Register(*api.Schema, api.Compatibility) (uint32, error)
+	Get(version uint32) (*api.Schema, error)
+	Validate(value []byte) error
+}
+
+const (
+	// defaultRangeRecords is the number of records ConsumeRange returns at most when the request sets no limit.
+	defaultRangeRecords = 100
+	// rangePollInterval is how often ConsumeRange checks for appended records while it waits for one.
+	rangePollInterval = 10 * time.Millisecond
+	// streamPollInterval is how often ConsumeStream checks for appended records once it reached the end of the log.
+	streamPollInterval = 10 * time.Millisecond
+)
+
 var _ api.LogServer = (*grpcServer)(nil) // TODO: understand why blank identifier is created by type conversion of nil
 
+// NewGRPCServer creates a gRPC server serving the log, its administration and the health of both. Calls to the
+// Admin service are authorized by the config's Authorizer. Errors returned by the handlers are mapped to the
+// errors of api/v1 before the interceptors passed in opts see them.
 func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(config.unaryAuthInterceptor, config.unaryErrorInterceptor),
+		grpc.ChainStreamInterceptor(config.streamAuthInterceptor, config.streamErrorInterceptor),
+	)
 	gsrv := grpc.NewServer(opts...)
 	srv, err := newgrpcServer(config)
 	if err != nil {
 		return nil, err
 	}
 	api.RegisterLogServer(gsrv, srv)
+	admin, err := newadminServer(config)
+	if err != nil {
+		return nil, err
+	}
+	api.RegisterAdminServer(gsrv, admin)
+	health, err := newhealthServer(config)
+	if err != nil {
+		return nil, err
+	}
+	healthpb.RegisterHealthServer(gsrv, health)
+	if config.Reflection {
+		reflection.Register(gsrv)
+	}
 	return gsrv, nil
 }
 
@@ -47,7 +144,17 @@ func newgrpcServer(config *Config) (srv *grpcServer, err error) {
 
 // Produce appends a record to the log and returns the offset for the record.
 // The ProduceRequest parameter wraps the record to be appended, while the ProduceResponse which is returned wraps the offset.
+// Requests carrying a producer ID are deduplicated by the log using the request's sequence number.
+// When a schema is registered, records whose value does not conform to its latest version are rejected.
 func (g *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if err := g.checkRecord(req.Record); err != nil {
+		return nil, err
+	}
+	if req.ProducerId != 0 {
+		req.Record.ProducerId = req.ProducerId
+		req.Record.Sequence = req.Sequence
+	}
+	req.Record.TxnId = req.TxnId
 	off, err := g.CommitLog.Append(req.Record)
 	if err != nil {
 		return nil, err
@@ -55,10 +162,77 @@ func (g *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 	return &api.ProduceResponse{Offset: off}, nil
 }
 
+// checkRecord verifies that a produced record is within the log's size limit, if it has one, and conforms to the
+// registered schema.
+func (g *grpcServer) checkRecord(record *api.Record) error {
+	if record == nil {
+		return status.Error(codes.InvalidArgument, "record is required")
+	}
+	if limited, ok := g.CommitLog.(LimitedLog); ok {
+		if size, max := uint64(proto.Size(record)), limited.MaxRecordBytes(); max != 0 && size > max {
+			return api.ErrorRecordTooLarge{Size: size, Max: max}
+		}
+	}
+	if g.Schemas != nil {
+		return g.Schemas.Validate(record.Value)
+	}
+	return nil
+}
+
+// ProduceBatch appends records to the log at consecutive offsets and returns the range of their offsets.
+// If the log implements BatchLog, the batch is appended atomically, though a crash of the server may still leave
+// part of it in the log. Otherwise the records are appended one by one and a failed batch may be partly appended.
+func (g *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "records are required")
+	}
+	for i, record := range req.Records {
+		if err := g.checkRecord(record); err != nil {
+			return nil, err
+		}
+		if req.ProducerId != 0 {
+			record.ProducerId = req.ProducerId
+			record.Sequence = req.Sequence + uint64(i)
+		}
+		if record.ProducerId != req.Records[0].ProducerId {
+			return nil, status.Error(codes.InvalidArgument, "records of a batch must have the same producer")
+		}
+		record.TxnId = req.TxnId
+	}
+	if batchLog, ok := g.CommitLog.(BatchLog); ok {
+		first, last, err := batchLog.AppendBatch(req.Records)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ProduceBatchResponse{FirstOffset: first, LastOffset: last, Atomic: true}, nil
+	}
+	res := &api.ProduceBatchResponse{}
+	for i, record := range req.Records {
+		off, err := g.CommitLog.Append(record)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			res.FirstOffset = off
+		}
+		res.LastOffset = off
+	}
+	return res, nil
+}
+
 // Consume reads a record from the log given an offset.
 // The ConsumeRequest paramter wraps the requested offset, while the ConsumeResponse which is returned wraps the record.
+// With ReadCommitted set, the first committed record at or after the requested offset is returned.
 func (g *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	record, err := g.CommitLog.Read(req.Offset)
+	read := g.CommitLog.Read
+	if req.ReadCommitted {
+		txnLog, ok := g.CommitLog.(TxnLog)
+		if !ok {
+			return nil, status.Error(codes.Unimplemented, "read-committed isolation is not supported")
+		}
+		read = txnLog.ReadCommitted
+	}
+	record, err := read(req.Offset)
 	if err != nil {
 		return nil, err
 	}
@@ -85,8 +259,26 @@ func (g *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 
 // ConsumeStream is a server side streaming service. Client can indicate the offset from which it wants to read records,
 // while the server streams the records starting at the given offset. When the end of the log is reached, server waits
-// till the next record comes in and then continues streaming.
+// till the next record comes in and then continues streaming. Expired records and gaps in the log's offsets are
+// skipped. The stream fails with OutOfRange if its offset falls below the lowest offset of the log, as when the
+// records were truncated or evicted before they were streamed.
+//
+// If FromCommitted is set, streaming starts at the offset committed by the request's group instead of the
+// requested offset. The requested offset is used if the group has not committed an offset yet.
 func (g *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	if req.FromCommitted {
+		if g.Offsets == nil {
+			return status.Error(codes.Unimplemented, "committed offsets are not supported")
+		}
+		off, err := g.Offsets.Fetch(req.Group, req.Topic, req.Partition)
+		switch err.(type) {
+		case nil:
+			req.Offset = off
+		case api.ErrorNoCommittedOffset:
+		default:
+			return err
+		}
+	}
 	for {
 		select {
 		case <-stream.Context().Done():
@@ -96,6 +288,28 @@ func (g *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 			switch err.(type) {
 			case nil:
 			case api.ErrorOffsetOutOfRange:
+				if next := g.skipGap(req.Offset); next != req.Offset {
+					req.Offset = next
+					continue
+				}
+				if rangeLog, ok := g.CommitLog.(OffsetRangeLog); ok {
+					lowest, lerr := rangeLog.LowestOffset()
+					if lerr != nil {
+						return lerr
+					}
+					if req.Offset < lowest {
+						return err
+					}
+				}
+				// wait for the next record to be appended
+				select {
+				case <-stream.Context().Done():
+					return nil
+				case <-time.After(streamPollInterval):
+				}
+				continue
+			case api.ErrorRecordExpired:
+				req.Offset++
 				continue
 			default:
 				return err
@@ -103,7 +317,155 @@ func (g *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 			if err = stream.Send(res); err != nil {
 				return err
 			}
-			req.Offset++
+			req.Offset = res.Record.Offset + 1
+		}
+	}
+}
+
+// ConsumeRange reads the records from the requested offset on, up to the requested number of records and bytes.
+// Expired records and gaps in the log's offsets are skipped. If there is no record at the offset yet, it waits up to max_wait_ms for one to be
+// appended, and returns no record if none was.
+func (g *grpcServer) ConsumeRange(ctx context.Context, req *api.ConsumeRangeRequest) (*api.ConsumeRangeResponse, error) {
+	maxRecords := int(req.MaxRecords)
+	if maxRecords == 0 {
+		maxRecords = defaultRangeRecords
+	}
+	res := &api.ConsumeRangeResponse{NextOffset: req.Offset}
+	var size uint64
+	read := func() error {
+		for len(res.Records) < maxRecords {
+			rec, err := g.Consume(ctx, &api.ConsumeRequest{Offset: res.NextOffset, ReadCommitted: req.ReadCommitted})
+			switch err.(type) {
+			case nil:
+			case api.ErrorOffsetOutOfRange:
+				if next := g.skipGap(res.NextOffset); next != res.NextOffset {
+					res.NextOffset = next
+					continue
+				}
+				return nil
+			case api.ErrorRecordExpired:
+				res.NextOffset++
+				continue
+			default:
+				return err
+			}
+			n := uint64(proto.Size(rec.Record))
+			if req.MaxBytes != 0 && len(res.Records) > 0 && size+n > req.MaxBytes {
+				return nil
+			}
+			size += n
+			res.Records = append(res.Records, rec.Record)
+			res.NextOffset = rec.Record.Offset + 1
 		}
+		return nil
+	}
+	if err := read(); err != nil {
+		return nil, err
+	}
+	if len(res.Records) > 0 || req.MaxWaitMs == 0 {
+		return res, nil
+	}
+	timeout := time.NewTimer(time.Duration(req.MaxWaitMs) * time.Millisecond)
+	defer timeout.Stop()
+	poll := time.NewTicker(rangePollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout.C:
+			return res, nil
+		case <-poll.C:
+			if err := read(); err != nil {
+				return nil, err
+			}
+			if len(res.Records) > 0 {
+				return res, nil
+			}
+		}
+	}
+}
+
+// skipGap returns the offset of the first record at or after the given offset, skipping a gap in the log's
+// offsets if the log has gaps.
+func (g *grpcServer) skipGap(offset uint64) uint64 {
+	if gapLog, ok := g.CommitLog.(GapLog); ok {
+		return gapLog.SkipGap(offset)
+	}
+	return offset
+}
+
+// CommitOffset stores the offset committed by a consumer group for a topic and partition.
+func (g *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if g.Offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "committed offsets are not supported")
+	}
+	if err := g.Offsets.Commit(req.Group, req.Topic, req.Partition, req.Offset); err != nil {
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+// FetchOffset returns the offset last committed by a consumer group for a topic and partition.
+func (g *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (*api.FetchOffsetResponse, error) {
+	if g.Offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "committed offsets are not supported")
+	}
+	off, err := g.Offsets.Fetch(req.Group, req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FetchOffsetResponse{Offset: off}, nil
+}
+
+// BeginTxn starts a transaction and returns its ID.
+func (g *grpcServer) BeginTxn(ctx context.Context, req *api.BeginTxnRequest) (*api.BeginTxnResponse, error) {
+	txnLog, ok := g.CommitLog.(TxnLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "transactions are not supported")
+	}
+	id, err := txnLog.BeginTxn()
+	if err != nil {
+		return nil, err
+	}
+	return &api.BeginTxnResponse{TxnId: id}, nil
+}
+
+// CommitTxn commits a transaction and returns the offset of its commit marker.
+func (g *grpcServer) CommitTxn(ctx context.Context, req *api.CommitTxnRequest) (*api.CommitTxnResponse, error) {
+	txnLog, ok := g.CommitLog.(TxnLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "transactions are not supported")
+	}
+	off, err := txnLog.CommitTxn(req.TxnId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.CommitTxnResponse{Offset: off}, nil
+}
+
+// AbortTxn aborts a transaction and returns the offset of its abort marker.
+func (g *grpcServer) AbortTxn(ctx context.Context, req *api.AbortTxnRequest) (*api.AbortTxnResponse, error) {
+	txnLog, ok := g.CommitLog.(TxnLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "transactions are not supported")
+	}
+	off, err := txnLog.AbortTxn(req.TxnId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AbortTxnResponse{Offset: off}, nil
+}
+
+// LookupKey returns the latest record appended with the requested key.
+func (g *grpcServer) LookupKey(ctx context.Context, req *api.LookupKeyRequest) (*api.LookupKeyResponse, error) {
+	keyLog, ok := g.CommitLog.(KeyLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "key lookups are not supported")
+	}
+	record, err := keyLog.LookupKey(req.Key)
+	if err != nil {
+		return nil, err
 	}
+	return &api.LookupKeyResponse{Record: record}, nil
 }
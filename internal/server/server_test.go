@@ -1,17 +1,31 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	stdlog "log"
+	"math"
 	"net"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	api "github.com/kartpop/dclog/api/v1"
+	"github.com/kartpop/dclog/internal/auth"
 	"github.com/kartpop/dclog/internal/config"
 	"github.com/kartpop/dclog/internal/log"
+	"github.com/kartpop/dclog/internal/offset"
+	"github.com/kartpop/dclog/internal/schema"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
 func TestServer(t *testing.T) {
@@ -19,16 +33,106 @@ func TestServer(t *testing.T) {
 		"produce/consume to/from log succeeds": testProduceConsume,
 		"produce/consume stream succeeds":      testProduceConsumeStream,
 		"consume past log boundary fails":      testConsumePastBoundary,
+		"commit/fetch offset succeeds":         testCommitFetchOffset,
+		"consume stream from committed offset": testConsumeStreamFromCommitted,
+		"retried produce is deduplicated":      testIdempotentProduce,
+		"read committed consume":               testReadCommittedConsume,
+		"consume stream skips expired records": testConsumeStreamSkipsExpired,
+		"consume skips gaps in offsets":        testConsumeSkipsGaps,
+		"lookup key succeeds":                  testLookupKey,
+		"produce batch/consume range":          testProduceBatchConsumeRange,
 	}
 	for testCase, fn := range testFuncs {
 		t.Run(testCase, func(t *testing.T) {
-			client, config, teardown := setupTest(t, nil) // TODO: why have 2nd param if nil is always passed
+			client, _, config, teardown := setupTest(t, nil)
 			defer teardown()
 			fn(t, client, config)
 		})
 	}
 }
 
+func TestServerInMemory(t *testing.T) {
+	testFuncs := map[string]func(t *testing.T, client api.LogClient, config *Config){
+		"produce/consume to/from log succeeds": testProduceConsume,
+		"produce/consume stream succeeds":      testProduceConsumeStream,
+		"consume past log boundary fails":      testConsumePastBoundary,
+		"produce batch/consume range":          testProduceBatchConsumeRange,
+		"consume stream below lowest offset":   testConsumeStreamBelowLowest,
+	}
+	for testCase, fn := range testFuncs {
+		t.Run(testCase, func(t *testing.T) {
+			authorizer := auth.New()
+			authorizer.Grant("client", auth.RoleAdmin)
+			config := &Config{CommitLog: log.NewMemoryLog(log.Config{}), Authorizer: authorizer}
+			client, _, teardown := setupServer(t, config)
+			defer teardown()
+			fn(t, client, config)
+		})
+	}
+}
+
+func TestHealth(t *testing.T) {
+	_, _, config, teardown := setupTest(t, nil)
+	defer teardown()
+	h, err := newhealthServer(config)
+	require.NoError(t, err)
+	ctx := context.Background()
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		res, err := h.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		return res.Status
+	}
+	for _, service := range []string{"", logService, adminService} {
+		require.Equal(t, healthpb.HealthCheckResponse_SERVING, check(service))
+	}
+	_, err = h.Check(ctx, &healthpb.HealthCheckRequest{Service: "log.v1.Unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// without a leader, only the Admin service serves
+	config.HasLeader = func() bool { return false }
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(""))
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(logService))
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check(adminService))
+	config.HasLeader = nil
+
+	// a log on a full disk still serves the Admin service
+	clog := config.CommitLog.(*log.Log)
+	clog.Config.Limits.MinFreeBytes = math.MaxUint64
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(logService))
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check(adminService))
+	clog.Config.Limits.MinFreeBytes = 0
+
+	require.NoError(t, clog.Close())
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(adminService))
+}
+
+func TestReflection(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		srv, err := NewGRPCServer(&Config{Reflection: enabled})
+		require.NoError(t, err)
+		services := srv.GetServiceInfo()
+		require.Contains(t, services, "grpc.health.v1.Health")
+		_, ok := services["grpc.reflection.v1alpha.ServerReflection"]
+		require.Equal(t, enabled, ok)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	testFuncs := map[string]func(t *testing.T, client api.LogClient, admin api.AdminClient, config *Config){
+		"stats succeeds":                testStats,
+		"registered schema is enforced": testSchema,
+		"manage log":                    testManageLog,
+		"admin requires admin role":     testAdminRole,
+	}
+	for testCase, fn := range testFuncs {
+		t.Run(testCase, func(t *testing.T) {
+			client, admin, config, teardown := setupTest(t, nil)
+			defer teardown()
+			fn(t, client, admin, config)
+		})
+	}
+}
+
 func testProduceConsume(t *testing.T, client api.LogClient, config *Config) {
 	// test Produce
 	ctx := context.Background()
@@ -110,7 +214,271 @@ func testProduceConsumeStream(t *testing.T, client api.LogClient, config *Config
 	}
 }
 
-func setupTest(t *testing.T, fn func(*Config)) (client api.LogClient, cfg *Config, teardown func()) {
+func testCommitFetchOffset(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "group", Topic: "topic"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "group", Topic: "topic", Offset: 7})
+	require.NoError(t, err)
+	res, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "group", Topic: "topic"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), res.Offset)
+}
+
+func testConsumeStreamFromCommitted(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	for _, value := range []string{"first", "second", "third"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+	}
+	_, err := client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "group", Topic: "topic", Offset: 2})
+	require.NoError(t, err)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Group: "group", Topic: "topic", FromCommitted: true})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Record.Offset)
+	require.Equal(t, []byte("third"), res.Record.Value)
+}
+
+func testIdempotentProduce(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	req := &api.ProduceRequest{
+		Record:     &api.Record{Value: []byte("hello world")},
+		ProducerId: 1,
+		Sequence:   1,
+	}
+	first, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	retry, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset, retry.Offset)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: first.Offset + 1})
+	require.Equal(t, grpc.Code(api.ErrorOffsetOutOfRange{}.GRPCStatus().Err()), grpc.Code(err))
+}
+
+func testReadCommittedConsume(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	begin, err := client.BeginTxn(ctx, &api.BeginTxnRequest{})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("in txn")}, TxnId: begin.TxnId})
+	require.NoError(t, err)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{ReadCommitted: true})
+	require.Equal(t, grpc.Code(api.ErrorOffsetOutOfRange{}.GRPCStatus().Err()), grpc.Code(err))
+
+	_, err = client.CommitTxn(ctx, &api.CommitTxnRequest{TxnId: begin.TxnId})
+	require.NoError(t, err)
+	res, err := client.Consume(ctx, &api.ConsumeRequest{ReadCommitted: true})
+	require.NoError(t, err)
+	require.Equal(t, []byte("in txn"), res.Record.Value)
+
+	// markers are only written by the log
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Control: api.Control_CONTROL_COMMIT}, TxnId: begin.TxnId})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testConsumeStreamSkipsExpired(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	expired := &api.Record{Value: []byte("expired"), ExpiresAt: time.Now().Add(-time.Second).UnixNano()}
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: expired})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("live")}})
+	require.NoError(t, err)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("live"), res.Record.Value)
+}
+
+func testConsumeStreamBelowLowest(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	for _, value := range []string{"evicted", "kept"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, config.CommitLog.(TruncateLog).Truncate(0))
+
+	// a stream behind the lowest offset fails rather than waiting for records which are gone
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// a stream at the end of the log waits for the next record
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 2})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("next")}})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("next"), res.Record.Value)
+}
+
+func testConsumeSkipsGaps(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	// an import preserving offsets leaves a gap before offset 5
+	imported := `{"offset":0,"timestamp":1,"value":"first","encoding":"utf8"}` + "\n" +
+		`{"offset":5,"timestamp":1,"value":"after the gap","encoding":"utf8"}` + "\n"
+	_, err := log.Import(config.CommitLog.(*log.Log), strings.NewReader(imported), log.ImportOptions{PreserveOffsets: true})
+	require.NoError(t, err)
+
+	rng, err := client.ConsumeRange(ctx, &api.ConsumeRangeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Len(t, rng.Records, 1)
+	require.Equal(t, uint64(5), rng.Records[0].Offset)
+	require.Equal(t, uint64(6), rng.NextOffset)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("after the gap"), res.Record.Value)
+}
+
+func testLookupKey(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.LookupKey(ctx, &api.LookupKeyRequest{Key: []byte("user-1")})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	for _, value := range []string{"v1", "v2"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Key: []byte("user-1"), Value: []byte(value)}})
+		require.NoError(t, err)
+	}
+	res, err := client.LookupKey(ctx, &api.LookupKeyRequest{Key: []byte("user-1")})
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), res.Record.Value)
+	require.Equal(t, uint64(1), res.Record.Offset)
+}
+
+func TestProduceTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-test-limit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Limits.MaxRecordBytes = 64
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+
+	// the limit is the log's
+	for _, commitLog := range []CommitLog{clog, log.NewMemoryLog(c)} {
+		client, _, _, teardown := setupTest(t, func(config *Config) {
+			config.CommitLog = commitLog
+		})
+		ctx := context.Background()
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: make([]byte, 128)}})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+		_, err = client.Produce(ctx, &api.ProduceRequest{})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+		require.NoError(t, err)
+		teardown()
+	}
+}
+
+func testStats(t *testing.T, client api.LogClient, admin api.AdminClient, config *Config) {
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+	}
+	res, err := admin.Stats(ctx, &api.StatsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(res.Segments)), res.SegmentCount)
+	last := res.Segments[len(res.Segments)-1]
+	require.False(t, last.Sealed)
+	require.Equal(t, uint64(3), last.NextOffset)
+	require.NotZero(t, res.TotalBytes)
+}
+
+func testSchema(t *testing.T, client api.LogClient, admin api.AdminClient, config *Config) {
+	ctx := context.Background()
+	_, err := admin.GetSchema(ctx, &api.GetSchemaRequest{})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	res, err := admin.RegisterSchema(ctx, &api.RegisterSchemaRequest{Schema: &api.Schema{
+		Type:       api.SchemaType_SCHEMA_TYPE_JSON,
+		Definition: []byte(`{"type": "object", "properties": {"name": {"type": "string"}}, "required": ["name"]}`),
+	}})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), res.Version)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(`{"name": "dclog"}`)}})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(`{"name": 1}`)}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// a version requiring a property the latest version does not write cannot read its values
+	_, err = admin.RegisterSchema(ctx, &api.RegisterSchemaRequest{
+		Schema: &api.Schema{
+			Type:       api.SchemaType_SCHEMA_TYPE_JSON,
+			Definition: []byte(`{"type": "object", "required": ["name", "id"]}`),
+		},
+		Compatibility: api.Compatibility_COMPATIBILITY_BACKWARD,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	get, err := admin.GetSchema(ctx, &api.GetSchemaRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), get.Schema.Version)
+}
+
+func setupTest(t *testing.T, fn func(*Config)) (client api.LogClient, admin api.AdminClient, cfg *Config, teardown func()) {
+	t.Helper()
+
+	offsetDir, err := ioutil.TempDir("", "server-test-offsets")
+	require.NoError(t, err)
+	offsets, err := offset.NewStore(offsetDir, offset.Config{})
+	require.NoError(t, err)
+
+	schemaDir, err := ioutil.TempDir("", "server-test-schemas")
+	require.NoError(t, err)
+	schemas, err := schema.NewRegistry(schemaDir)
+	require.NoError(t, err)
+
+	authorizer := auth.New()
+	authorizer.Grant("client", auth.RoleAdmin)
+
+	cfg = &Config{
+		Offsets:    offsets,
+		Schemas:    schemas,
+		Authorizer: authorizer,
+	}
+	if fn != nil {
+		fn(cfg)
+	}
+	// a log on disk is only created if fn did not set one
+	var clog *log.Log
+	if cfg.CommitLog == nil {
+		dir, err := ioutil.TempDir("", "server-test")
+		require.NoError(t, err)
+		clog, err = log.NewLog(dir, log.Config{})
+		require.NoError(t, err)
+		cfg.CommitLog = clog
+	}
+	client, admin, stop := setupServer(t, cfg)
+	return client, admin, cfg, func() {
+		stop()
+		if clog != nil {
+			clog.Remove()
+		}
+		offsets.Remove()
+		os.RemoveAll(schemaDir)
+	}
+}
+
+// setupServer serves the given configuration over TLS and returns clients of its services. Unlike setupTest, it
+// creates nothing on disk.
+func setupServer(t *testing.T, cfg *Config) (client api.LogClient, admin api.AdminClient, teardown func()) {
 	t.Helper()
 
 	// setup client
@@ -129,6 +497,7 @@ func setupTest(t *testing.T, fn func(*Config)) (client api.LogClient, cfg *Confi
 	require.NoError(t, err)
 
 	client = api.NewLogClient(clientConn)
+	admin = api.NewAdminClient(clientConn)
 
 	// setup server
 	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
@@ -141,18 +510,6 @@ func setupTest(t *testing.T, fn func(*Config)) (client api.LogClient, cfg *Confi
 	require.NoError(t, err)
 
 	serverCreds := credentials.NewTLS(serverTLSConfig)
-	dir, err := ioutil.TempDir("", "server-test")
-	require.NoError(t, err)
-
-	clog, err := log.NewLog(dir, log.Config{})
-	require.NoError(t, err)
-
-	cfg = &Config{
-		CommitLog: clog,
-	}
-	if fn != nil { // fn is always nil, seems unnecessary
-		fn(cfg)
-	}
 	server, err := NewGRPCServer(cfg, grpc.Creds(serverCreds))
 	require.NoError(t, err)
 
@@ -160,10 +517,185 @@ func setupTest(t *testing.T, fn func(*Config)) (client api.LogClient, cfg *Confi
 		server.Serve(listener)
 	}()
 
-	return client, cfg, func() {
+	return client, admin, func() {
 		server.Stop()
 		clientConn.Close()
 		listener.Close()
-		clog.Remove()
 	}
 }
+
+// failingLog is a commit log whose operations fail with the given errors.
+type failingLog struct {
+	appendErr, readErr error
+}
+
+func (f failingLog) Append(*api.Record) (uint64, error) { return 0, f.appendErr }
+
+func (f failingLog) Read(uint64) (*api.Record, error) { return nil, f.readErr }
+
+func TestErrorCodes(t *testing.T) {
+	ctx := context.Background()
+	client, _, _, teardown := setupTest(t, nil)
+	_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+	teardown()
+
+	tests := []struct {
+		err  error
+		code codes.Code
+	}{
+		{fmt.Errorf("%w: record length 99 at position 0 is beyond the end of the store", log.ErrCorrupt), codes.DataLoss},
+		{&log.CorruptionError{Offset: 3, Reason: "checksum mismatch"}, codes.DataLoss},
+		{log.ErrReadOnly, codes.FailedPrecondition},
+		{log.ErrNotOpen, codes.Unavailable},
+		{fmt.Errorf("reset: %w", log.ErrLocked), codes.FailedPrecondition},
+		{fmt.Errorf("append: %w", api.ErrorControlRecord{}), codes.InvalidArgument},
+		{fmt.Errorf("append: %w", api.ErrorResourceExhausted{Reason: "the log is full"}), codes.ResourceExhausted},
+		{errors.New("disk on fire"), codes.Internal},
+	}
+	for _, tt := range tests {
+		var logged bytes.Buffer
+		client, _, _, teardown := setupTest(t, func(c *Config) {
+			c.CommitLog = failingLog{appendErr: tt.err, readErr: tt.err}
+			c.ErrorLog = stdlog.New(&logged, "", 0)
+		})
+		_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+		teardown()
+		require.Equal(t, tt.code, status.Code(err), tt.err.Error())
+		require.NotEmpty(t, status.Convert(err).Details())
+		if tt.code == codes.Internal {
+			// the detail of an internal error is logged rather than sent to the client
+			require.NotContains(t, err.Error(), "disk on fire")
+			require.Contains(t, logged.String(), "/log.v1.Log/Consume: disk on fire")
+		}
+	}
+
+	client, _, _, teardown = setupTest(t, func(c *Config) {
+		c.CommitLog = failingLog{appendErr: fmt.Errorf("replicate: %w", api.ErrorNotLeader{Leader: "10.0.0.2:8400"})}
+	})
+	defer teardown()
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	leader, ok := api.LeaderHint(err)
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.2:8400", leader)
+}
+
+func testProduceBatchConsumeRange(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	var records []*api.Record
+	for _, v := range []string{"first", "second", "third", "fourth"} {
+		records = append(records, &api.Record{Value: []byte(v)})
+	}
+	res, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.FirstOffset)
+	require.Equal(t, uint64(3), res.LastOffset)
+	_, atomic := config.CommitLog.(BatchLog)
+	require.Equal(t, atomic, res.Atomic)
+
+	mixed := []*api.Record{{Value: []byte("a"), ProducerId: 1}, {Value: []byte("b"), ProducerId: 2}}
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: mixed})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	rng, err := client.ConsumeRange(ctx, &api.ConsumeRangeRequest{Offset: 1, MaxRecords: 2})
+	require.NoError(t, err)
+	require.Len(t, rng.Records, 2)
+	require.Equal(t, "second", string(rng.Records[0].Value))
+	require.Equal(t, "third", string(rng.Records[1].Value))
+	require.Equal(t, uint64(3), rng.NextOffset)
+
+	// the first record is returned even if it alone exceeds max_bytes
+	rng, err = client.ConsumeRange(ctx, &api.ConsumeRangeRequest{Offset: 0, MaxBytes: 1})
+	require.NoError(t, err)
+	require.Len(t, rng.Records, 1)
+
+	rng, err = client.ConsumeRange(ctx, &api.ConsumeRangeRequest{Offset: 4})
+	require.NoError(t, err)
+	require.Empty(t, rng.Records)
+	require.Equal(t, uint64(4), rng.NextOffset)
+
+	// a waiting request returns the record appended while it waits
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		config.CommitLog.Append(&api.Record{Value: []byte("fifth")})
+	}()
+	rng, err = client.ConsumeRange(ctx, &api.ConsumeRangeRequest{Offset: 4, MaxWaitMs: 5000})
+	require.NoError(t, err)
+	require.Len(t, rng.Records, 1)
+	require.Equal(t, "fifth", string(rng.Records[0].Value))
+
+	rng, err = client.ConsumeRange(ctx, &api.ConsumeRangeRequest{Offset: 5, MaxWaitMs: 20})
+	require.NoError(t, err)
+	require.Empty(t, rng.Records)
+}
+
+func TestAdminWithoutAuthorizer(t *testing.T) {
+	client, admin, _, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = nil
+	})
+	defer teardown()
+	ctx := context.Background()
+	_, err := admin.Reset(ctx, &api.ResetRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = admin.TruncateAfter(ctx, &api.TruncateAfterRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = admin.Stats(ctx, &api.StatsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+}
+
+func testManageLog(t *testing.T, client api.LogClient, admin api.AdminClient, config *Config) {
+	ctx := context.Background()
+	produce := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+			require.NoError(t, err)
+		}
+	}
+	produce(2)
+	roll, err := admin.ForceRoll(ctx, &api.ForceRollRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), roll.BaseOffset)
+	// an empty active segment is not rolled
+	roll, err = admin.ForceRoll(ctx, &api.ForceRollRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), roll.BaseOffset)
+	produce(3)
+
+	segments, err := admin.ListSegments(ctx, &api.ListSegmentsRequest{})
+	require.NoError(t, err)
+	require.Len(t, segments.Segments, 2)
+	require.True(t, segments.Segments[0].Sealed)
+	require.Equal(t, uint64(2), segments.Segments[0].NextOffset)
+
+	_, err = admin.Truncate(ctx, &api.TruncateRequest{Before: 2})
+	require.NoError(t, err)
+	_, err = admin.TruncateAfter(ctx, &api.TruncateAfterRequest{Offset: 3})
+	require.NoError(t, err)
+	offsets, err := admin.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offsets.LowestOffset)
+	require.Equal(t, uint64(3), offsets.HighestOffset)
+
+	_, err = admin.Reset(ctx, &api.ResetRequest{})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 2})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+	res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+}
+
+func testAdminRole(t *testing.T, client api.LogClient, admin api.AdminClient, config *Config) {
+	ctx := context.Background()
+	config.Authorizer.(*auth.Authorizer).Revoke("client", auth.RoleAdmin)
+	_, err := admin.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = admin.Reset(ctx, &api.ResetRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	// the Log service is open to all clients
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+}